@@ -1,24 +1,30 @@
-// Package vagorillasessionsstores is a Gorilla sessions.Store implementation for BadgerDB, MongoDB and Dgraph
+// Package vagorillasessionsstores is a Gorilla sessions.Store implementation for BadgerDB, MongoDB, Dgraph, Redis and SQL databases
 package vagorillasessionsstores
 
 import (
-	"encoding/base32"
-	"net/http"
+	"context"
+	"encoding/json"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	badger "github.com/dgraph-io/badger/v2"
-	"github.com/gorilla/securecookie"
-	"github.com/gorilla/sessions"
 )
 
+// badgerGCInterval is how often the value log garbage collector runs.
+const badgerGCInterval = 5 * time.Minute
+
 // NewBadgerStore returns a new BadgerStore.
 //
 // Path represents a filesystem directory where Badger is located. It will be created if it doesn't exist.
 // Badger's DefaultOptions are used badger.DefaultOptions(path).
 // For use with custom options see NewBadgerStoreWithOpts()
 //
+// A background value log garbage collector is started with the store.
+// Call Close() to stop it and release the database.
+//
 // Keys are defined in pairs to allow key rotation, but the common case is
 // to set a single authentication key and optionally an encryption key.
 //
@@ -34,182 +40,486 @@ func NewBadgerStore(path string, keyPairs ...[]byte) (*BadgerStore, error) {
 		path = filepath.Join(os.TempDir(), "badger")
 	}
 
-	db, err := badger.Open(badger.DefaultOptions(path))
-	if err != nil {
-		return nil, err
-	}
-
-	store := &BadgerStore{
-		Codecs: securecookie.CodecsFromPairs(keyPairs...),
-		Options: &sessions.Options{
-			Path:   "/",
-			MaxAge: 86400 * 30,
-		},
-		db: db,
-	}
-
-	store.MaxAge(store.Options.MaxAge)
-	return store, nil
+	return NewBadgerStoreWithOpts(badger.DefaultOptions(path), keyPairs...)
 }
 
 // NewBadgerStoreWithOpts is intended for advanced configuration of Badger.
 // Create a new variable `opts := badger.Options{}` and set on it the desired settings.
 // For more information please see Badger's documentation https://github.com/dgraph-io/badger
+//
+// A background value log garbage collector is started with the store.
+// Call Close() to stop it and release the database.
 func NewBadgerStoreWithOpts(opts badger.Options, keyPairs ...[]byte) (*BadgerStore, error) {
 	db, err := badger.Open(opts)
 	if err != nil {
 		return nil, err
 	}
 
+	backend := NewBadgerBackend(db)
 	store := &BadgerStore{
-		Codecs: securecookie.CodecsFromPairs(keyPairs...),
-		Options: &sessions.Options{
-			Path:   "/",
-			MaxAge: 86400 * 30,
-		},
-		db: db,
+		Store:   NewStore(backend, keyPairs...),
+		backend: backend,
 	}
 
-	store.MaxAge(store.Options.MaxAge)
 	return store, nil
 }
 
 // BadgerStore stores sessions using BadgerDB
 type BadgerStore struct {
-	Codecs  []securecookie.Codec
-	Options *sessions.Options
-	db      *badger.DB
+	*Store
+	backend *BadgerBackend
 }
 
-// Get returns a session for the given name after adding it to the registry.
-//
-// It returns a new session if the sessions doesn't exist. Access IsNew on
-// the session to check if it is an existing session or a new one.
-//
-// It returns a new session and an error if the session exists but could
-// not be decoded.
-func (s *BadgerStore) Get(r *http.Request, name string) (*sessions.Session, error) {
-	return sessions.GetRegistry(r).Get(s, name)
+// Close stops the value log garbage collector and closes the underlying Badger database.
+func (s *BadgerStore) Close() error {
+	return s.backend.Close()
 }
 
-// New returns a session for the given name without adding it to the registry.
-//
-// The difference between New() and Get() is that calling New() twice will
-// decode the session data twice, while Get() registers and reuses the same
-// decoded session after the first call.
-func (s *BadgerStore) New(r *http.Request, name string) (*sessions.Session, error) {
-	session := sessions.NewSession(s, name)
-	opts := *s.Options
-	session.Options = &opts
-	session.IsNew = true
-	var err error
-	if c, errCookie := r.Cookie(name); errCookie == nil {
-		err = securecookie.DecodeMulti(name, c.Value, &session.ID,
-			s.Codecs...)
-		err = s.load(session)
-		if err == nil {
-			session.IsNew = false
-		}
-	}
-	return session, err
-}
-
-// Save adds a single session to the response.
+// NewBadgerBackend returns a Backend persisting sessions in db.
 //
-// If the Options.MaxAge of the session is <= 0 then the session file will be
-// deleted from the store path. With this process it enforces the properly
-// session cookie handling so no need to trust in the cookie management in the
-// web browser.
-func (s *BadgerStore) Save(r *http.Request, w http.ResponseWriter,
-	session *sessions.Session) error {
-	// Delete if max-age is <= 0
-	if session.Options.MaxAge <= 0 {
-		if err := s.erase(session); err != nil {
+// The backend takes ownership of db: it starts a background value log garbage
+// collector and closes the database on Close().
+func NewBadgerBackend(db *badger.DB) *BadgerBackend {
+	b := &BadgerBackend{
+		db:     db,
+		stopGC: make(chan struct{}),
+	}
+
+	b.gc.Add(1)
+	go b.runGC()
+	return b
+}
+
+// BadgerBackend is a Backend storing sessions in BadgerDB under "session_"+ID keys.
+// Session expiry is enforced with Badger TTLs.
+type BadgerBackend struct {
+	db     *badger.DB
+	stopGC chan struct{}
+	gc     sync.WaitGroup
+	// closed makes Close() safe to call more than once.
+	closed   sync.Once
+	closeErr error
+
+	// locks serializes lock attempts of the process, sparing them transaction conflicts.
+	locks sync.Mutex
+}
+
+// Name returns "badger".
+func (b *BadgerBackend) Name() string {
+	return "badger"
+}
+
+// decodeBadgerEntry decodes a stored value. Values written before entries
+// carried metadata hold the encoded session values only.
+func decodeBadgerEntry(val []byte) jsonEntry {
+	entry, err := decodeJSONEntry(val)
+	if err != nil {
+		return jsonEntry{Value: val}
+	}
+	return entry
+}
+
+// record converts a stored item to a Record.
+func (b *BadgerBackend) record(item *badger.Item) (*Record, error) {
+	val, err := item.ValueCopy(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := decodeBadgerEntry(val)
+	rec := entry.record(strings.TrimPrefix(string(item.Key()), "session_"))
+	// The key expires with the session, its TTL is the expiry to trust.
+	rec.ExpiresAt = time.Time{}
+	if expiresAt := item.ExpiresAt(); expiresAt > 0 {
+		rec.ExpiresAt = time.Unix(int64(expiresAt), 0)
+	}
+
+	return rec, nil
+}
+
+// Load implements Backend.
+func (b *BadgerBackend) Load(ctx context.Context, id string) (*Record, error) {
+	var rec *Record
+
+	err := b.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte("session_" + id))
+		if err != nil {
 			return err
 		}
-		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
-		return nil
+
+		rec, err = b.record(item)
+		return err
+	})
+	if err == badger.ErrKeyNotFound {
+		return nil, ErrSessionNotFound
 	}
+	if err != nil {
+		return nil, err
+	}
+
+	return rec, nil
+}
+
+// Save implements Backend.
+//
+// Sessions bound to a user are also indexed under a "user_"+userID+"\x00"+ID
+// key expiring together with the session. Versions are checked in the
+// transaction, a concurrent write makes it fail with ErrConcurrentModification.
+func (b *BadgerBackend) Save(ctx context.Context, rec *Record) error {
+	return badgerConflict(b.db.Update(func(txn *badger.Txn) error {
+		return b.put(txn, rec.ID, rec)
+	}))
+}
+
+// Rename implements Renamer in a single transaction.
+func (b *BadgerBackend) Rename(ctx context.Context, oldID string, rec *Record) error {
+	return badgerConflict(b.db.Update(func(txn *badger.Txn) error {
+		return b.put(txn, oldID, rec)
+	}))
+}
 
-	if session.ID == "" {
-		session.ID = strings.TrimRight(
-			base32.StdEncoding.EncodeToString(
-				securecookie.GenerateRandomKey(32)), "=")
+// badgerConflict reports transactions aborted by a concurrent write as ErrConcurrentModification.
+func badgerConflict(err error) error {
+	if err == badger.ErrConflict {
+		return ErrConcurrentModification
+	}
+	return err
+}
+
+// put writes rec in txn, replacing the record stored under oldID
+// if its version is rec.Version.
+func (b *BadgerBackend) put(txn *badger.Txn, oldID string, rec *Record) error {
+	stored := *rec
+	stored.Version = 1
+	oldKey := []byte("session_" + oldID)
+	if item, err := txn.Get(oldKey); err == nil {
+		old, err := b.record(item)
+		if err != nil {
+			return err
+		}
+		if rec.Version != 0 && old.Version != rec.Version {
+			return ErrConcurrentModification
+		}
+		stored.Version = old.Version + 1
+		if !old.Created.IsZero() {
+			stored.Created = old.Created
+		}
+		if old.UserID != "" && (old.UserID != rec.UserID || oldID != rec.ID) {
+			if err := txn.Delete(badgerUserKey(old.UserID, oldID)); err != nil {
+				return err
+			}
+		}
+		if oldID != rec.ID {
+			if err := txn.Delete(oldKey); err != nil {
+				return err
+			}
+		}
+	} else if err != badger.ErrKeyNotFound {
+		return err
+	} else if rec.Version != 0 {
+		// Deleted since it was loaded.
+		return ErrConcurrentModification
 	}
-	if err := s.save(session); err != nil {
+
+	if err := b.write(txn, &stored); err != nil {
 		return err
 	}
-	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID,
-		s.Codecs...)
+	rec.Version = stored.Version
+	return nil
+}
+
+// write sets the entries storing rec in txn, with a TTL matching its expiry.
+func (b *BadgerBackend) write(txn *badger.Txn, rec *Record) error {
+	val, err := json.Marshal(newJSONEntry(rec))
 	if err != nil {
 		return err
 	}
 
-	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	entries := []*badger.Entry{badger.NewEntry([]byte("session_"+rec.ID), val)}
+	if rec.UserID != "" {
+		entries = append(entries, badger.NewEntry(badgerUserKey(rec.UserID, rec.ID), nil))
+	}
+
+	for _, entry := range entries {
+		if !rec.ExpiresAt.IsZero() {
+			entry = entry.WithTTL(time.Until(rec.ExpiresAt))
+		}
+		if err := txn.SetEntry(entry); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-// MaxAge sets the maximum age for the store and the underlying cookie
-// implementation. Individual sessions can be deleted by setting Options.MaxAge
-// = -1 for that session.
-func (s *BadgerStore) MaxAge(age int) {
-	s.Options.MaxAge = age
+// Touch implements Toucher. Badger TTLs are set per entry, so the stored
+// entry is written again with its values as they are.
+func (b *BadgerBackend) Touch(ctx context.Context, id string, updated, expiresAt time.Time) error {
+	err := b.db.Update(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte("session_" + id))
+		if err != nil {
+			return err
+		}
 
-	// Set the maxAge for each securecookie instance.
-	for _, codec := range s.Codecs {
-		if sc, ok := codec.(*securecookie.SecureCookie); ok {
-			sc.MaxAge(age)
+		rec, err := b.record(item)
+		if err != nil {
+			return err
 		}
+		// The values are unchanged, so is the version.
+		rec.Updated = updated
+		rec.ExpiresAt = expiresAt
+		return b.write(txn, rec)
+	})
+	if err == badger.ErrKeyNotFound {
+		return ErrSessionNotFound
 	}
+	return badgerConflict(err)
 }
 
-func (s *BadgerStore) save(session *sessions.Session) error {
-	encoded, err := securecookie.EncodeMulti(session.Name(), session.Values,
-		s.Codecs...)
+// Delete implements Backend.
+func (b *BadgerBackend) Delete(ctx context.Context, id string) error {
+	key := []byte("session_" + id)
+
+	return b.db.Update(func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		rec, err := b.record(item)
+		if err != nil {
+			return err
+		}
+		if rec.UserID != "" {
+			if err := txn.Delete(badgerUserKey(rec.UserID, id)); err != nil {
+				return err
+			}
+		}
+
+		return txn.Delete(key)
+	})
+}
+
+// List implements Lister by iterating over the "session_" key prefix.
+// Filters are applied while iterating, without decoding session values.
+func (b *BadgerBackend) List(ctx context.Context, opts ListOptions) ([]SessionInfo, string, error) {
+	var infos []SessionInfo
+	var next string
+
+	prefix := []byte("session_")
+	err := b.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		start := prefix
+		if opts.Cursor != "" {
+			// Seek to the first key after the cursor.
+			start = []byte("session_" + opts.Cursor + "\x00")
+		}
+
+		for it.Seek(start); it.ValidForPrefix(prefix); it.Next() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			rec, err := b.record(it.Item())
+			if err != nil {
+				return err
+			}
+
+			info := rec.info()
+			if !opts.match(info) {
+				continue
+			}
+
+			if len(infos) == opts.limit() {
+				next = infos[len(infos)-1].ID
+				return nil
+			}
+			infos = append(infos, info)
+		}
+
+		return nil
+	})
 	if err != nil {
-		return err
+		return nil, "", err
 	}
 
-	return s.db.Update(func(txn *badger.Txn) error {
-		err := txn.Set([]byte("session_"+session.ID), []byte(encoded))
-		return err
+	return infos, next, nil
+}
+
+// badgerUserKey returns the key indexing session id under userID.
+func badgerUserKey(userID, id string) []byte {
+	return []byte("user_" + userID + "\x00" + id)
+}
+
+// userSessions returns the IDs of the sessions indexed under userID.
+func (b *BadgerBackend) userSessions(txn *badger.Txn, userID string) []string {
+	prefix := badgerUserKey(userID, "")
+
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	var ids []string
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		ids = append(ids, string(it.Item().Key()[len(prefix):]))
+	}
+	return ids
+}
+
+// ListByUser implements UserIndexer using the user index keys.
+func (b *BadgerBackend) ListByUser(ctx context.Context, userID string) ([]SessionInfo, error) {
+	var infos []SessionInfo
+
+	err := b.db.View(func(txn *badger.Txn) error {
+		for _, id := range b.userSessions(txn, userID) {
+			item, err := txn.Get([]byte("session_" + id))
+			if err == badger.ErrKeyNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			rec, err := b.record(item)
+			if err != nil {
+				return err
+			}
+
+			infos = append(infos, rec.info())
+		}
+		return nil
 	})
+	if err != nil {
+		return nil, err
+	}
+
+	return infos, nil
+}
+
+// DeleteByUser implements UserIndexer, deleting all sessions of userID in one transaction.
+func (b *BadgerBackend) DeleteByUser(ctx context.Context, userID string) error {
+	return b.db.Update(func(txn *badger.Txn) error {
+		for _, id := range b.userSessions(txn, userID) {
+			if err := txn.Delete([]byte("session_" + id)); err != nil {
+				return err
+			}
+			if err := txn.Delete(badgerUserKey(userID, id)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// badgerLease is the value of the key of a session lock, see TryLock().
+type badgerLease struct {
+	Token   string    `json:"token"`
+	Expires time.Time `json:"expires"`
 }
 
-func (s *BadgerStore) load(session *sessions.Session) error {
-	var queryResp []byte
+// TryLock implements Locker with a "lock_"+ID key holding the token and the
+// end of the lease. Badger databases are opened by a single process,
+// attempts are serialized in memory and checked in a transaction.
+//
+// Badger expires keys at whole seconds, so the end of the lease is checked
+// from the value and the key is only given a TTL rounded up past it, to
+// clean it up.
+func (b *BadgerBackend) TryLock(ctx context.Context, id, token string, ttl time.Duration) (bool, error) {
+	b.locks.Lock()
+	defer b.locks.Unlock()
 
-	err := s.db.View(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte("session_" + session.ID))
+	acquired := false
+	err := b.db.Update(func(txn *badger.Txn) error {
+		key := []byte("lock_" + id)
+		now := time.Now()
+		held, err := badgerLock(txn, key)
 		if err != nil {
 			return err
 		}
-
-		err = item.Value(func(val []byte) error {
-			queryResp = append(queryResp, val...)
+		if held != nil && held.Token != token && held.Expires.After(now) {
 			return nil
-		})
+		}
+
+		lease, err := json.Marshal(badgerLease{Token: token, Expires: now.Add(ttl)})
 		if err != nil {
 			return err
 		}
 
-		return nil
+		acquired = true
+		return txn.SetEntry(badger.NewEntry(key, lease).WithTTL(ttl + time.Second))
 	})
-	if err != nil {
-		return err
+	if err == badger.ErrConflict {
+		return false, nil
 	}
+	return acquired && err == nil, err
+}
+
+// Unlock implements Locker.
+func (b *BadgerBackend) Unlock(ctx context.Context, id, token string) error {
+	b.locks.Lock()
+	defer b.locks.Unlock()
 
-	return securecookie.DecodeMulti(session.Name(), string(queryResp), &session.Values, s.Codecs...)
+	return b.db.Update(func(txn *badger.Txn) error {
+		key := []byte("lock_" + id)
+		held, err := badgerLock(txn, key)
+		if err != nil || held == nil || held.Token != token {
+			return err
+		}
+		return txn.Delete(key)
+	})
 }
 
-func (s *BadgerStore) erase(session *sessions.Session) error {
-	err := s.db.Update(func(txn *badger.Txn) error {
-		err := txn.Delete([]byte("session_" + session.ID))
-		return err
+// badgerLock returns the lease stored under key, nil if there is none.
+func badgerLock(txn *badger.Txn, key []byte) (*badgerLease, error) {
+	item, err := txn.Get(key)
+	if err == badger.ErrKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var lease badgerLease
+	err = item.Value(func(val []byte) error {
+		return json.Unmarshal(val, &lease)
 	})
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return &lease, nil
+}
 
-	return err
+// Close stops the value log garbage collector and closes the underlying Badger database.
+// Later calls return the result of the first one.
+func (b *BadgerBackend) Close() error {
+	b.closed.Do(func() {
+		close(b.stopGC)
+		b.gc.Wait()
+		b.closeErr = b.db.Close()
+	})
+	return b.closeErr
+}
+
+// runGC periodically reclaims value log space left behind by expired and deleted sessions.
+func (b *BadgerBackend) runGC() {
+	defer b.gc.Done()
+
+	ticker := time.NewTicker(badgerGCInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.stopGC:
+			return
+		case <-ticker.C:
+			// Keep collecting until Badger reports there is nothing left to rewrite.
+			for b.db.RunValueLogGC(0.5) == nil {
+			}
+		}
+	}
 }
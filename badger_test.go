@@ -1,9 +1,16 @@
 package vagorillasessionsstores
 
 import (
+	"context"
+	"errors"
 	"net/http"
 	"net/http/httptest"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/bh90210/vagorillasessionsstores/storetest"
+	"github.com/gorilla/sessions"
 )
 
 // Test for BadgerStore
@@ -59,6 +66,13 @@ func TestBadgerStoreDelete(t *testing.T) {
 	if err != nil {
 		t.Fatal("failed to delete session", err)
 	}
+	exists, err := store.Exists(context.Background(), session.ID)
+	if err != nil {
+		t.Fatal("failed to check session", err)
+	}
+	if exists {
+		t.Fatal("expected the session to be deleted")
+	}
 }
 
 // Test delete badger store with max-age: 0
@@ -89,4 +103,494 @@ func TestBadgerStoreDelete2(t *testing.T) {
 	if err != nil {
 		t.Fatal("failed to delete session", err)
 	}
+	exists, err := store.Exists(context.Background(), session.ID)
+	if err != nil {
+		t.Fatal("failed to check session", err)
+	}
+	if exists {
+		t.Fatal("expected the session to be deleted")
+	}
+}
+
+// Test that closing a badger store twice is not an error
+func TestBadgerStoreCloseTwice(t *testing.T) {
+	store, err := NewBadgerStore(t.TempDir(), []byte("some key"))
+	if err != nil {
+		t.Fatal("failed to create store", err)
+	}
+
+	if err := store.Close(); err != nil {
+		t.Fatal("failed to close store", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal("failed to close store again", err)
+	}
+}
+
+// Test that badger entries expire together with the session cookie
+func TestBadgerStoreExpiry(t *testing.T) {
+	store, err := NewBadgerStore(t.TempDir(), []byte("some key"))
+	if err != nil {
+		t.Fatal("failed to create store", err)
+	}
+	defer store.Close()
+
+	req, err := http.NewRequest("GET", "http://www.example.com", nil)
+	if err != nil {
+		t.Fatal("failed to create request", err)
+	}
+	w := httptest.NewRecorder()
+
+	session, err := store.New(req, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+
+	session.Values["foo"] = "bar"
+	session.Options.MaxAge = 1
+	err = session.Save(req, w)
+	if err != nil {
+		t.Fatal("failed to save session", err)
+	}
+
+	req, err = http.NewRequest("GET", "http://www.example.com", nil)
+	if err != nil {
+		t.Fatal("failed to create request", err)
+	}
+	req.Header.Add("Cookie", w.Header().Get("Set-Cookie"))
+
+	session, err = store.New(req, "hello")
+	if err != nil {
+		t.Fatal("failed to load session", err)
+	}
+	if session.IsNew || session.Values["foo"] != "bar" {
+		t.Fatalf("session not loaded: IsNew %v, values %v", session.IsNew, session.Values)
+	}
+
+	time.Sleep(2 * time.Second)
+
+	session, err = store.New(req, "hello")
+	if err != nil {
+		t.Fatal("expired session should not return an error", err)
+	}
+	if !session.IsNew {
+		t.Fatal("expired session should be new")
+	}
+}
+
+// Test listing badger sessions page by page
+func TestBadgerStoreList(t *testing.T) {
+	store, err := NewBadgerStore(t.TempDir(), []byte("some key"))
+	if err != nil {
+		t.Fatal("failed to create store", err)
+	}
+	defer store.Close()
+
+	ctx := context.Background()
+	for _, name := range []string{"hello", "hello", "world"} {
+		session := sessions.NewSession(store, name)
+		session.Options = &sessions.Options{MaxAge: 60}
+		if err := store.SaveByID(ctx, session); err != nil {
+			t.Fatal("failed to save session", err)
+		}
+	}
+
+	infos, next, err := store.List(ctx, ListOptions{Limit: 2})
+	if err != nil {
+		t.Fatal("failed to list sessions", err)
+	}
+	if len(infos) != 2 || next == "" {
+		t.Fatalf("bad first page: %d sessions, next %q", len(infos), next)
+	}
+
+	infos, next, err = store.List(ctx, ListOptions{Limit: 2, Cursor: next})
+	if err != nil {
+		t.Fatal("failed to list sessions", err)
+	}
+	if len(infos) != 1 || next != "" {
+		t.Fatalf("bad last page: %d sessions, next %q", len(infos), next)
+	}
+
+	var hello int
+	err = store.Iterate(ctx, ListOptions{Name: "hello", Limit: 1}, func(info SessionInfo) error {
+		if info.Name != "hello" || info.Created.IsZero() || info.ExpiresAt.IsZero() {
+			t.Fatalf("bad session info: %+v", info)
+		}
+		hello++
+		return nil
+	})
+	if err != nil {
+		t.Fatal("failed to iterate sessions", err)
+	}
+	if hello != 2 {
+		t.Fatalf("expected 2 hello sessions, got %d", hello)
+	}
+
+	infos, _, err = store.List(ctx, ListOptions{CreatedAfter: time.Now()})
+	if err != nil {
+		t.Fatal("failed to list sessions", err)
+	}
+	if len(infos) != 0 {
+		t.Fatalf("expected no sessions created in the future, got %d", len(infos))
+	}
+}
+
+// Test revoking all badger sessions of a user
+func TestBadgerStoreRevokeAllForUser(t *testing.T) {
+	store, err := NewBadgerStore(t.TempDir(), []byte("some key"))
+	if err != nil {
+		t.Fatal("failed to create store", err)
+	}
+	defer store.Close()
+
+	ctx := context.Background()
+	var ids []string
+	for _, userID := range []string{"alice", "alice", "bob", ""} {
+		session := sessions.NewSession(store, "hello")
+		session.Options = &sessions.Options{MaxAge: 60}
+		SetUserID(session, userID)
+		if err := store.SaveByID(ctx, session); err != nil {
+			t.Fatal("failed to save session", err)
+		}
+		ids = append(ids, session.ID)
+	}
+
+	infos, err := store.ListSessionsForUser(ctx, "alice")
+	if err != nil {
+		t.Fatal("failed to list sessions", err)
+	}
+	if len(infos) != 2 || infos[0].UserID != "alice" {
+		t.Fatalf("expected 2 sessions of alice, got %+v", infos)
+	}
+
+	// Moving a session to another user drops it from the previous user's index.
+	session, err := store.LoadByID(ctx, "hello", ids[1])
+	if err != nil {
+		t.Fatal("failed to load session", err)
+	}
+	if UserID(session) != "alice" {
+		t.Fatalf("bad user ID %q", UserID(session))
+	}
+	SetUserID(session, "bob")
+	if err := store.SaveByID(ctx, session); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+
+	if err := store.RevokeAllForUser(ctx, "bob"); err != nil {
+		t.Fatal("failed to revoke sessions", err)
+	}
+
+	// Sessions not bound to a user belong to no one.
+	if infos, err := store.ListSessionsForUser(ctx, ""); err != nil || len(infos) != 0 {
+		t.Fatalf("expected no sessions for an empty user ID, got %+v %v", infos, err)
+	}
+	if err := store.RevokeAllForUser(ctx, ""); err != nil {
+		t.Fatal("failed to revoke sessions", err)
+	}
+
+	for i, want := range []bool{true, false, false, true} {
+		ok, err := store.Exists(ctx, ids[i])
+		if err != nil {
+			t.Fatal("failed to check session", err)
+		}
+		if ok != want {
+			t.Fatalf("session %d: exists %v, want %v", i, ok, want)
+		}
+	}
+}
+
+// Test regenerating the ID of a badger session in a single transaction
+func TestBadgerStoreRegenerateID(t *testing.T) {
+	store, err := NewBadgerStore(t.TempDir(), []byte("some key"))
+	if err != nil {
+		t.Fatal("failed to create store", err)
+	}
+	defer store.Close()
+
+	req, err := http.NewRequest("GET", "http://www.example.com", nil)
+	if err != nil {
+		t.Fatal("failed to create request", err)
+	}
+
+	session, err := store.New(req, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	SetUserID(session, "alice")
+	if err := session.Save(req, httptest.NewRecorder()); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+
+	ctx := context.Background()
+	oldID := session.ID
+	before, err := store.ListSessionsForUser(ctx, "alice")
+	if err != nil || len(before) != 1 {
+		t.Fatalf("failed to list sessions: %v %+v", err, before)
+	}
+
+	if err := store.RegenerateID(req, httptest.NewRecorder(), session); err != nil {
+		t.Fatal("failed to regenerate session ID", err)
+	}
+
+	if ok, _ := store.Exists(ctx, oldID); ok {
+		t.Fatal("old session not deleted")
+	}
+
+	infos, err := store.ListSessionsForUser(ctx, "alice")
+	if err != nil {
+		t.Fatal("failed to list sessions", err)
+	}
+	if len(infos) != 1 || infos[0].ID != session.ID {
+		t.Fatalf("user index not moved to the new ID: %+v", infos)
+	}
+	if !infos[0].Created.Equal(before[0].Created) {
+		t.Fatalf("creation time not kept: %v, was %v", infos[0].Created, before[0].Created)
+	}
+
+	if _, err := store.LoadByID(ctx, "hello", session.ID); err != nil {
+		t.Fatal("failed to load renamed session", err)
+	}
+}
+
+// Test that binary and text values both survive the Badger entry encoding
+func TestBadgerStoreSerializer(t *testing.T) {
+	store, err := NewBadgerStore(t.TempDir(), []byte("some key"))
+	if err != nil {
+		t.Fatal("failed to create store", err)
+	}
+	defer store.Close()
+
+	ctx := context.Background()
+	for _, serializer := range []Serializer{MsgpackSerializer{}, JSONSerializer{}} {
+		store.Serializer = serializer
+
+		session := sessions.NewSession(store, "hello")
+		session.Options = &sessions.Options{MaxAge: 60}
+		session.Values["foo"] = "bar"
+		if err := store.SaveByID(ctx, session); err != nil {
+			t.Fatal("failed to save session", err)
+		}
+
+		loaded, err := store.LoadByID(ctx, "hello", session.ID)
+		if err != nil {
+			t.Fatal("failed to load session", err)
+		}
+		if loaded.Values["foo"] != "bar" {
+			t.Fatalf("session not loaded: %v", loaded.Values)
+		}
+	}
+}
+
+// Test refreshing the expiry of a session without saving it
+func TestBadgerStoreTouch(t *testing.T) {
+	store, err := NewBadgerStore(t.TempDir(), []byte("some key"))
+	if err != nil {
+		t.Fatal("failed to create store", err)
+	}
+	defer store.Close()
+	store.IdleTimeout = time.Hour
+
+	ctx := context.Background()
+	session := sessions.NewSession(store, "hello")
+	session.Options = &sessions.Options{MaxAge: 60}
+	session.Values["foo"] = "bar"
+	if err := store.SaveByID(ctx, session); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	before, err := store.backend.Load(ctx, session.ID)
+	if err != nil {
+		t.Fatal("failed to load record", err)
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+	if err := store.Touch(ctx, session); err != nil {
+		t.Fatal("failed to touch session", err)
+	}
+
+	after, err := store.backend.Load(ctx, session.ID)
+	if err != nil {
+		t.Fatal("failed to load record", err)
+	}
+	if !after.Updated.After(before.Updated) || !after.ExpiresAt.After(before.ExpiresAt) {
+		t.Fatalf("session not touched: %v %v", after.Updated, after.ExpiresAt)
+	}
+	if !after.Created.Equal(before.Created) || string(after.Value) != string(before.Value) {
+		t.Fatal("touch changed the stored session")
+	}
+
+	session.ID = "missing"
+	if err := store.Touch(ctx, session); err != ErrSessionNotFound {
+		t.Fatalf("expected ErrSessionNotFound, got %v", err)
+	}
+}
+
+// Test that a session saved concurrently since it was loaded is not overwritten
+func TestBadgerStoreConcurrentModification(t *testing.T) {
+	store, err := NewBadgerStore(t.TempDir(), []byte("some key"))
+	if err != nil {
+		t.Fatal("failed to create store", err)
+	}
+	defer store.Close()
+
+	ctx := context.Background()
+	session := sessions.NewSession(store, "hello")
+	session.Options = &sessions.Options{MaxAge: 60}
+	if err := store.SaveByID(ctx, session); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+
+	first, err := store.LoadByID(ctx, "hello", session.ID)
+	if err != nil {
+		t.Fatal("failed to load session", err)
+	}
+	second, err := store.LoadByID(ctx, "hello", session.ID)
+	if err != nil {
+		t.Fatal("failed to load session", err)
+	}
+
+	first.Values["a"] = "1"
+	if err := store.SaveByID(ctx, first); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	first.Values["b"] = "2"
+	if err := store.SaveByID(ctx, first); err != nil {
+		t.Fatal("failed to save the session a second time", err)
+	}
+
+	second.Values["c"] = "3"
+	if err := store.SaveByID(ctx, second); !errors.Is(err, ErrConcurrentModification) {
+		t.Fatalf("expected ErrConcurrentModification, got %v", err)
+	}
+
+	store.Merge = func(ctx context.Context, session, stored *sessions.Session) error {
+		for k, v := range stored.Values {
+			if _, ok := session.Values[k]; !ok {
+				session.Values[k] = v
+			}
+		}
+		return nil
+	}
+	if err := store.SaveByID(ctx, second); err != nil {
+		t.Fatal("failed to save merged session", err)
+	}
+
+	loaded, err := store.LoadByID(ctx, "hello", session.ID)
+	if err != nil {
+		t.Fatal("failed to load session", err)
+	}
+	if loaded.Values["a"] != "1" || loaded.Values["b"] != "2" || loaded.Values["c"] != "3" {
+		t.Fatalf("bad merged values %v", loaded.Values)
+	}
+}
+
+// Test that a session lock is held by one holder at a time
+func TestBadgerStoreLock(t *testing.T) {
+	store, err := NewBadgerStore(t.TempDir(), []byte("some key"))
+	if err != nil {
+		t.Fatal("failed to create store", err)
+	}
+	defer store.Close()
+
+	ctx := context.Background()
+	lock, err := store.Lock(ctx, "session", time.Minute)
+	if err != nil {
+		t.Fatal("failed to lock session", err)
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel()
+	if _, err := store.Lock(waitCtx, "session", time.Minute); err != context.DeadlineExceeded {
+		t.Fatalf("expected the second lock to time out, got %v", err)
+	}
+
+	if _, err := store.Lock(ctx, "other", time.Minute); err != nil {
+		t.Fatal("failed to lock another session", err)
+	}
+
+	if err := lock.Extend(ctx, time.Minute); err != nil {
+		t.Fatal("failed to extend lock", err)
+	}
+	if err := lock.Unlock(ctx); err != nil {
+		t.Fatal("failed to unlock session", err)
+	}
+	if _, err := store.Lock(ctx, "session", time.Minute); err != nil {
+		t.Fatal("failed to lock unlocked session", err)
+	}
+
+	// Leases shorter than Badger's one second TTL granularity last their full TTL.
+	if ok, err := store.backend.TryLock(ctx, "short", "a", 300*time.Millisecond); err != nil || !ok {
+		t.Fatalf("failed to lock session: %v %v", ok, err)
+	}
+	if ok, err := store.backend.TryLock(ctx, "short", "b", time.Minute); err != nil || ok {
+		t.Fatalf("short lease taken over before its end: %v %v", ok, err)
+	}
+	time.Sleep(350 * time.Millisecond)
+	if ok, err := store.backend.TryLock(ctx, "short", "b", time.Minute); err != nil || !ok {
+		t.Fatalf("expired lease not taken over: %v %v", ok, err)
+	}
+}
+
+// Test that the lock middleware serializes the requests of a session
+func TestBadgerStoreLockMiddleware(t *testing.T) {
+	store, err := NewBadgerStore(t.TempDir(), []byte("some key"))
+	if err != nil {
+		t.Fatal("failed to create store", err)
+	}
+	defer store.Close()
+
+	req, err := http.NewRequest("GET", "http://www.example.com", nil)
+	if err != nil {
+		t.Fatal("failed to create request", err)
+	}
+	session, err := store.New(req, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	w := httptest.NewRecorder()
+	if err := session.Save(req, w); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	req.Header.Add("Cookie", w.Header().Get("Set-Cookie"))
+
+	var mu sync.Mutex
+	running, overlapped := 0, false
+	handler := store.LockMiddleware("hello", time.Minute)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		running++
+		overlapped = overlapped || running > 1
+		mu.Unlock()
+
+		time.Sleep(50 * time.Millisecond)
+
+		mu.Lock()
+		running--
+		mu.Unlock()
+	}))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+		}()
+	}
+	wg.Wait()
+
+	if overlapped {
+		t.Fatal("requests of the same session ran concurrently")
+	}
+}
+
+// Test BadgerStore against the conformance suite
+func TestBadgerStoreConformance(t *testing.T) {
+	store, err := NewBadgerStore(t.TempDir(), []byte("some key"))
+	if err != nil {
+		t.Fatal("failed to create store", err)
+	}
+	defer store.Close()
+
+	storetest.RunConformance(t, func(t *testing.T, keyPairs ...[]byte) sessions.Store {
+		return NewStore(store.backend, keyPairs...)
+	})
 }
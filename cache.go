@@ -0,0 +1,294 @@
+package vagorillasessionsstores
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// NewCachedBackend returns a Backend keeping up to size recently used
+// records of backend in memory, each for at most ttl and never past the
+// session's expiry. Saves are written through to backend and deletes evict
+// at once.
+//
+// The cache is local to the process: with several instances sharing a
+// database, a session changed by one instance may be served stale by
+// another for up to ttl.
+func NewCachedBackend(backend Backend, size int, ttl time.Duration) *CachedBackend {
+	return &CachedBackend{
+		backend: backend,
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// CachedBackend is a read-through LRU cache in front of a Backend.
+// It forwards the optional interfaces of the wrapped back-end.
+type CachedBackend struct {
+	// Accessed atomically, first for 64-bit alignment.
+	hits   uint64
+	misses uint64
+
+	backend Backend
+	size    int
+	ttl     time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+// CacheStats reports the activity of a CachedBackend.
+type CacheStats struct {
+	Hits    uint64
+	Misses  uint64
+	Entries int
+}
+
+// cacheEntry is a cached record and the time it leaves the cache.
+type cacheEntry struct {
+	rec     Record
+	expires time.Time
+}
+
+// EnableCache puts a CachedBackend in front of the store's back-end,
+// see NewCachedBackend(). It returns the cache to read its statistics.
+func (s *Store) EnableCache(size int, ttl time.Duration) *CachedBackend {
+	cache := NewCachedBackend(s.backend, size, ttl)
+	s.backend = cache
+	return cache
+}
+
+// Stats returns the hit and miss counts of the cache and its current size.
+func (c *CachedBackend) Stats() CacheStats {
+	c.mu.Lock()
+	entries := c.lru.Len()
+	c.mu.Unlock()
+
+	return CacheStats{
+		Hits:    atomic.LoadUint64(&c.hits),
+		Misses:  atomic.LoadUint64(&c.misses),
+		Entries: entries,
+	}
+}
+
+// Name returns the name of the wrapped back-end.
+func (c *CachedBackend) Name() string {
+	return backendName(c.backend)
+}
+
+// get returns a copy of the record cached under id.
+func (c *CachedBackend) get(id string) (*Record, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[id]
+	if !ok {
+		return nil, false
+	}
+
+	entry := e.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.remove(e)
+		return nil, false
+	}
+
+	c.lru.MoveToFront(e)
+	rec := entry.rec
+	return &rec, true
+}
+
+// put caches a copy of rec until the cache TTL or the session expiry, whichever comes first.
+func (c *CachedBackend) put(rec *Record) {
+	if c.size <= 0 {
+		return
+	}
+
+	expires := time.Now().Add(c.ttl)
+	if !rec.ExpiresAt.IsZero() && rec.ExpiresAt.Before(expires) {
+		expires = rec.ExpiresAt
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[rec.ID]; ok {
+		entry := e.Value.(*cacheEntry)
+		// Back-ends keep the stored creation time when replacing a record.
+		created := entry.rec.Created
+		entry.rec, entry.expires = *rec, expires
+		if !created.IsZero() {
+			entry.rec.Created = created
+		}
+		c.lru.MoveToFront(e)
+		return
+	}
+
+	c.entries[rec.ID] = c.lru.PushFront(&cacheEntry{rec: *rec, expires: expires})
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+}
+
+// evict removes the record cached under id, if any.
+func (c *CachedBackend) evict(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[id]; ok {
+		c.remove(e)
+	}
+}
+
+// remove drops e from the cache. c.mu must be held.
+func (c *CachedBackend) remove(e *list.Element) {
+	c.lru.Remove(e)
+	delete(c.entries, e.Value.(*cacheEntry).rec.ID)
+}
+
+// Load implements Backend, loading from the wrapped back-end on a miss.
+func (c *CachedBackend) Load(ctx context.Context, id string) (*Record, error) {
+	if rec, ok := c.get(id); ok {
+		atomic.AddUint64(&c.hits, 1)
+		return rec, nil
+	}
+	atomic.AddUint64(&c.misses, 1)
+
+	rec, err := c.backend.Load(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	c.put(rec)
+	return rec, nil
+}
+
+// Save implements Backend, writing through to the wrapped back-end.
+func (c *CachedBackend) Save(ctx context.Context, rec *Record) error {
+	if err := c.backend.Save(ctx, rec); err != nil {
+		// The stored record is unknown now.
+		c.evict(rec.ID)
+		return err
+	}
+
+	c.put(rec)
+	return nil
+}
+
+// Delete implements Backend.
+func (c *CachedBackend) Delete(ctx context.Context, id string) error {
+	c.evict(id)
+	return c.backend.Delete(ctx, id)
+}
+
+// Rename implements Renamer, with the wrapped back-end's Rename if it has one.
+func (c *CachedBackend) Rename(ctx context.Context, oldID string, rec *Record) error {
+	old, cached := c.get(oldID)
+	c.evict(oldID)
+
+	var err error
+	if renamer, ok := c.backend.(Renamer); ok {
+		err = renamer.Rename(ctx, oldID, rec)
+	} else if err = c.backend.Save(ctx, rec); err == nil {
+		err = c.backend.Delete(ctx, oldID)
+	}
+	if err != nil {
+		c.evict(rec.ID)
+		return err
+	}
+
+	if cached && !old.Created.IsZero() {
+		renamed := *rec
+		renamed.Created = old.Created
+		rec = &renamed
+	}
+	c.put(rec)
+	return nil
+}
+
+// Touch implements Toucher for the wrapped back-end. Without one, it returns
+// ErrNotSupported and the store rewrites the record through the cache.
+func (c *CachedBackend) Touch(ctx context.Context, id string, updated, expiresAt time.Time) error {
+	toucher, ok := c.backend.(Toucher)
+	if !ok {
+		return ErrNotSupported
+	}
+	if err := toucher.Touch(ctx, id, updated, expiresAt); err != nil {
+		c.evict(id)
+		return err
+	}
+
+	if rec, ok := c.get(id); ok {
+		rec.Updated = updated
+		rec.ExpiresAt = expiresAt
+		c.put(rec)
+	}
+	return nil
+}
+
+// StoresValues implements ValueStorer for the wrapped back-end.
+func (c *CachedBackend) StoresValues() bool {
+	vs, ok := c.backend.(ValueStorer)
+	return ok && vs.StoresValues()
+}
+
+// List implements Lister. Listings always come from the wrapped back-end.
+func (c *CachedBackend) List(ctx context.Context, opts ListOptions) ([]SessionInfo, string, error) {
+	lister, ok := c.backend.(Lister)
+	if !ok {
+		return nil, "", ErrNotSupported
+	}
+	return lister.List(ctx, opts)
+}
+
+// ListByUser implements UserIndexer.
+func (c *CachedBackend) ListByUser(ctx context.Context, userID string) ([]SessionInfo, error) {
+	indexer, ok := c.backend.(UserIndexer)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return indexer.ListByUser(ctx, userID)
+}
+
+// DeleteByUser implements UserIndexer, evicting the cached sessions of userID.
+func (c *CachedBackend) DeleteByUser(ctx context.Context, userID string) error {
+	indexer, ok := c.backend.(UserIndexer)
+	if !ok {
+		return ErrNotSupported
+	}
+
+	err := indexer.DeleteByUser(ctx, userID)
+
+	// Evict even on failure, some sessions may be gone.
+	c.mu.Lock()
+	for _, e := range c.entries {
+		if e.Value.(*cacheEntry).rec.UserID == userID {
+			c.remove(e)
+		}
+	}
+	c.mu.Unlock()
+
+	return err
+}
+
+// TryLock implements Locker for the wrapped back-end.
+func (c *CachedBackend) TryLock(ctx context.Context, id, token string, ttl time.Duration) (bool, error) {
+	locker, ok := c.backend.(Locker)
+	if !ok {
+		return false, ErrNotSupported
+	}
+	return locker.TryLock(ctx, id, token, ttl)
+}
+
+// Unlock implements Locker for the wrapped back-end.
+func (c *CachedBackend) Unlock(ctx context.Context, id, token string) error {
+	locker, ok := c.backend.(Locker)
+	if !ok {
+		return ErrNotSupported
+	}
+	return locker.Unlock(ctx, id, token)
+}
@@ -0,0 +1,88 @@
+package vagorillasessionsstores
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/bh90210/vagorillasessionsstores/storetest"
+	"github.com/gorilla/sessions"
+)
+
+// countingBackend is a memoryBackend counting the loads reaching it.
+type countingBackend struct {
+	*memoryBackend
+	loads int
+}
+
+func (b *countingBackend) Load(ctx context.Context, id string) (*Record, error) {
+	b.loads++
+	return b.memoryBackend.Load(ctx, id)
+}
+
+// Test that hot sessions are served from the cache and deletes evict them
+func TestCachedBackend(t *testing.T) {
+	backend := &countingBackend{memoryBackend: newMemoryBackend()}
+	store := NewStore(backend, []byte("some key"))
+	cache := store.EnableCache(2, time.Minute)
+	ctx := context.Background()
+
+	var ids []string
+	for i := 0; i < 3; i++ {
+		session := sessions.NewSession(store, "hello")
+		session.Options = &sessions.Options{MaxAge: 60}
+		session.Values["foo"] = "bar"
+		if err := store.SaveByID(ctx, session); err != nil {
+			t.Fatal("failed to save session", err)
+		}
+		ids = append(ids, session.ID)
+	}
+
+	// The first session was pushed out by the two others.
+	for _, id := range []string{ids[2], ids[1], ids[2], ids[0]} {
+		loaded, err := store.LoadByID(ctx, "hello", id)
+		if err != nil {
+			t.Fatal("failed to load session", err)
+		}
+		if loaded.Values["foo"] != "bar" {
+			t.Fatalf("session not loaded: %v", loaded.Values)
+		}
+	}
+	if stats := cache.Stats(); stats.Hits != 3 || stats.Misses != 1 || stats.Entries != 2 || backend.loads != 1 {
+		t.Fatalf("bad stats %+v, %d back-end loads", stats, backend.loads)
+	}
+
+	if err := store.DeleteByID(ctx, ids[2]); err != nil {
+		t.Fatal("failed to delete session", err)
+	}
+	if _, err := store.LoadByID(ctx, "hello", ids[2]); err != ErrSessionNotFound {
+		t.Fatalf("deleted session served from the cache: %v", err)
+	}
+
+	// Entries never outlive the session.
+	session, err := store.LoadByID(ctx, "hello", ids[0])
+	if err != nil {
+		t.Fatal("failed to load session", err)
+	}
+	session.Options.MaxAge = 1
+	if err := store.SaveByID(ctx, session); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if _, err := cache.Load(ctx, ids[0]); err != nil {
+		t.Fatal("failed to load record", err)
+	}
+	if stats := cache.Stats(); stats.Misses != 3 {
+		t.Fatalf("expired entry served from the cache: %+v", stats)
+	}
+}
+
+// Test a cached store against the conformance suite
+func TestCachedBackendConformance(t *testing.T) {
+	backend := newMemoryBackend()
+	storetest.RunConformance(t, func(t *testing.T, keyPairs ...[]byte) sessions.Store {
+		store := NewStore(backend, keyPairs...)
+		store.EnableCache(100, time.Minute)
+		return store
+	})
+}
@@ -1,19 +1,18 @@
-// Package vagorillasessionsstores is a Gorilla sessions.Store implementation for BadgerDB, MongoDB and Dgraph
+// Package vagorillasessionsstores is a Gorilla sessions.Store implementation for BadgerDB, MongoDB, Dgraph, Redis and SQL databases
 package vagorillasessionsstores
 
 import (
+	"bytes"
 	"context"
-	"encoding/base32"
+	"encoding/base64"
 	"encoding/json"
-	"errors"
-	"log"
-	"net/http"
+	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/dgraph-io/dgo/v200"
 	"github.com/dgraph-io/dgo/v200/protos/api"
-	"github.com/gorilla/securecookie"
-	"github.com/gorilla/sessions"
 	"google.golang.org/grpc"
 )
 
@@ -37,25 +36,67 @@ func NewDgraphStore(conn *grpc.ClientConn, keyPairs ...[]byte) (*DgraphStore, er
 	dc := api.NewDgraphClient(conn)
 	dg := dgo.NewDgraphClient(dc)
 
+	backend := NewDgraphBackend(dg)
 	store := &DgraphStore{
-		Codecs: securecookie.CodecsFromPairs(keyPairs...),
-		Options: &sessions.Options{
-			Path:   "/",
-			MaxAge: 86400 * 30,
-		},
-		db: dg,
+		Store:   NewStore(backend, keyPairs...),
+		backend: backend,
 	}
 
-	store.MaxAge(store.Options.MaxAge)
 	return store, nil
 }
 
 // NewDgraphStoreWithSchema returns a new Dgraph backed store but also initiates it with store's schema.
 // 	sessionid: string @index(hash) .
+// 	sessionname: string @index(exact) .
 // 	sessionvalue: string .
+// 	created: datetime @index(hour) .
+// 	updated: datetime @index(hour) .
+// 	expiresat: datetime @index(hour) .
+// 	version: int .
+// 	owner: uid @reverse .
+// 	userid: string @index(hash) @upsert .
+// 	sessionvalues: [uid] @reverse .
+// 	valuekey: string @index(exact) .
+// 	valuetype: string .
+// 	valuestring: string @index(exact) .
+// 	valueint: int @index(int) .
+// 	valuefloat: float @index(float) .
+// 	valuebool: bool @index(bool) .
+// 	valuetime: datetime @index(hour) .
+// 	valuejson: string .
+// 	valuenode: uid @reverse .
+// 	locksession: string @index(hash) @upsert .
+// 	locktoken: string @index(hash) .
+// 	lockexpires: datetime @index(hour) .
 // 	type Session {
 // 		sessionid
+// 		sessionname
 // 		sessionvalue
+// 		created
+// 		updated
+// 		expiresat
+// 		owner
+// 		sessionvalues
+// 		version
+// 	}
+// 	type User {
+// 		userid
+// 	}
+// 	type SessionValue {
+// 		valuekey
+// 		valuetype
+// 		valuestring
+// 		valueint
+// 		valuefloat
+// 		valuebool
+// 		valuetime
+// 		valuejson
+// 		valuenode
+// 	}
+// 	type SessionLock {
+// 		locksession
+// 		locktoken
+// 		lockexpires
 // 	}
 //
 // A gRPC connection is needed before the store initiates.
@@ -78,184 +119,594 @@ func NewDgraphStoreWithSchema(conn *grpc.ClientConn, keyPairs ...[]byte) (*Dgrap
 
 	op := &api.Operation{}
 	op.Schema = `
-	sessionid: string @index(hash) . 
-	sessionvalue: string . 
+	sessionid: string @index(hash) .
+	sessionname: string @index(exact) .
+	sessionvalue: string .
+	created: datetime @index(hour) .
+	updated: datetime @index(hour) .
+	expiresat: datetime @index(hour) .
+	version: int .
+	owner: uid @reverse .
+	userid: string @index(hash) @upsert .
+	sessionvalues: [uid] @reverse .
+	valuekey: string @index(exact) .
+	valuetype: string .
+	valuestring: string @index(exact) .
+	valueint: int @index(int) .
+	valuefloat: float @index(float) .
+	valuebool: bool @index(bool) .
+	valuetime: datetime @index(hour) .
+	valuejson: string .
+	valuenode: uid @reverse .
+	locksession: string @index(hash) @upsert .
+	locktoken: string @index(hash) .
+	lockexpires: datetime @index(hour) .
 	type Session {
 		sessionid
+		sessionname
 		sessionvalue
+		created
+		updated
+		expiresat
+		owner
+		sessionvalues
+		version
+	}
+	type User {
+		userid
+	}
+	type SessionValue {
+		valuekey
+		valuetype
+		valuestring
+		valueint
+		valuefloat
+		valuebool
+		valuetime
+		valuejson
+		valuenode
+	}
+	type SessionLock {
+		locksession
+		locktoken
+		lockexpires
 	}
 	`
 
 	ctx := context.Background()
 	err := dg.Alter(ctx, op)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
+	backend := NewDgraphBackend(dg)
 	store := &DgraphStore{
-		Codecs: securecookie.CodecsFromPairs(keyPairs...),
-		Options: &sessions.Options{
-			Path:   "/",
-			MaxAge: 86400 * 30,
-		},
-		db: dg,
+		Store:   NewStore(backend, keyPairs...),
+		backend: backend,
 	}
 
-	store.MaxAge(store.Options.MaxAge)
 	return store, nil
 }
 
-// DgraphStore stores sessions using MongoDB
+// DgraphStore stores sessions using Dgraph
 type DgraphStore struct {
-	Codecs  []securecookie.Codec
-	Options *sessions.Options
-	db      *dgo.Dgraph
+	*Store
+	backend *DgraphBackend
 }
 
-// Get returns a session for the given name after adding it to the registry.
-//
-// It returns a new session if the sessions doesn't exist. Access IsNew on
-// the session to check if it is an existing session or a new one.
-//
-// It returns a new session and an error if the session exists but could
-// not be decoded.
-func (s *DgraphStore) Get(r *http.Request, name string) (*sessions.Session, error) {
-	return sessions.GetRegistry(r).Get(s, name)
+// StartReaper starts a goroutine deleting expired sessions from Dgraph every interval.
+// See DgraphBackend.StartReaper().
+func (s *DgraphStore) StartReaper(interval time.Duration) {
+	s.backend.StartReaper(interval)
 }
 
-// New returns a session for the given name without adding it to the registry.
-//
-// The difference between New() and Get() is that calling New() twice will
-// decode the session data twice, while Get() registers and reuses the same
-// decoded session after the first call.
-func (s *DgraphStore) New(r *http.Request, name string) (*sessions.Session, error) {
-	session := sessions.NewSession(s, name)
-	opts := *s.Options
-	session.Options = &opts
-	session.IsNew = true
-	var err error
-	if c, errCookie := r.Cookie(name); errCookie == nil {
-		err = securecookie.DecodeMulti(name, c.Value, &session.ID,
-			s.Codecs...)
-		err = s.load(session)
+// SetOnReapError sets DgraphBackend.OnReapError, see there.
+func (s *DgraphStore) SetOnReapError(onError func(error)) {
+	s.backend.OnReapError = onError
+}
+
+// Close stops the reaper if it was started. The gRPC connection is left open.
+func (s *DgraphStore) Close() error {
+	return s.backend.Close()
+}
+
+// NewDgraphBackend returns a Backend persisting sessions as Session nodes in dg.
+func NewDgraphBackend(dg *dgo.Dgraph) *DgraphBackend {
+	return &DgraphBackend{
+		db: dg,
+	}
+}
+
+// DgraphBackend is a Backend storing one Session node per session.
+type DgraphBackend struct {
+	// NativeValues stores each session value as a typed SessionValue child
+	// node instead of an encoded sessionvalue string, so values can be
+	// queried and DgraphNode values link sessions to application nodes.
+	// Keys must be strings.
+	NativeValues bool
+
+	db *dgo.Dgraph
+
+	// OnReapError is called with the errors of the passes of the reaper, see
+	// StartReaper(). Errors are dropped when it is nil. Set it before
+	// starting the reaper.
+	OnReapError func(error)
+	reaper      reaper
+}
+
+// StartReaper starts a goroutine deleting expired sessions from Dgraph every interval.
+// Dgraph has no native expiry, without the reaper expired Session nodes are only
+// ignored, never removed. Each pass is bounded by interval, the reaper is
+// stopped by Close(), which cancels a pending pass.
+func (b *DgraphBackend) StartReaper(interval time.Duration) {
+	b.reaper.start(interval, b.reap, b.OnReapError)
+}
+
+// Close stops the reaper if it was started. The gRPC connection is left open.
+func (b *DgraphBackend) Close() error {
+	b.reaper.close()
+	return nil
+}
+
+// Session represents a custom Type in Dgraph
+type Session struct {
+	Uid          string    `json:"uid,omitempty"`
+	DType        []string  `json:"dgraph.type,omitempty"`
+	SessionID    string    `json:"sessionid,omitempty"`
+	SessionName  string    `json:"sessionname,omitempty"`
+	SessionValue string    `json:"sessionvalue,omitempty"`
+	Created      time.Time `json:"created"`
+	Updated      time.Time `json:"updated"`
+	ExpiresAt    time.Time `json:"expiresat"`
+	Owner        *User     `json:"owner,omitempty"`
+	Version      int64     `json:"version,omitempty"`
+	// SessionValues holds the session values stored with DgraphBackend.NativeValues.
+	SessionValues []SessionValue `json:"sessionvalues,omitempty"`
+}
+
+// User represents the owner of sessions in Dgraph, see SetUserID()
+type User struct {
+	Uid      string    `json:"uid,omitempty"`
+	DType    []string  `json:"dgraph.type,omitempty"`
+	UserID   string    `json:"userid,omitempty"`
+	Sessions []Session `json:"~owner,omitempty"`
+}
+
+// record converts the node to a Record.
+func (s *Session) record() *Record {
+	rec := &Record{
+		ID:        s.SessionID,
+		Name:      s.SessionName,
+		Value:     dgraphDecodeValue(s.SessionValue),
+		Created:   s.Created,
+		Updated:   s.Updated,
+		ExpiresAt: s.ExpiresAt,
+		Version:   s.Version,
+	}
+	if s.Owner != nil {
+		rec.UserID = s.Owner.UserID
+	}
+	return rec
+}
+
+// dgraphBase64Prefix marks session values that are not valid UTF-8,
+// stored base64 encoded in the sessionvalue string predicate.
+const dgraphBase64Prefix = "base64:"
+
+// dgraphEncodeValue returns the sessionvalue stored for value.
+func dgraphEncodeValue(value []byte) string {
+	if utf8.Valid(value) && !bytes.HasPrefix(value, []byte(dgraphBase64Prefix)) {
+		return string(value)
+	}
+	return dgraphBase64Prefix + base64.StdEncoding.EncodeToString(value)
+}
+
+// dgraphDecodeValue returns the session value stored as sessionvalue.
+func dgraphDecodeValue(sessionvalue string) []byte {
+	if strings.HasPrefix(sessionvalue, dgraphBase64Prefix) {
+		value, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(sessionvalue, dgraphBase64Prefix))
 		if err == nil {
-			session.IsNew = false
+			return value
 		}
 	}
-	return session, err
+	return []byte(sessionvalue)
 }
 
-// Save adds a single session to the response.
+// dgraphSessionFields lists the predicates of a session fetched by queries, without its value.
+const dgraphSessionFields = `
+	  sessionid
+	  sessionname
+	  created
+	  updated
+	  expiresat
+	  version
+	  owner {
+		userid
+	  }`
+
+// dgraphTime formats t as a Dgraph datetime.
+func dgraphTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// Name returns "dgraph".
+func (b *DgraphBackend) Name() string {
+	return "dgraph"
+}
+
+// Save implements Backend.
 //
-// If the Options.MaxAge of the session is <= 0 then the session file will be
-// deleted from the store path. With this process it enforces the properly
-// session cookie handling so no need to trust in the cookie management in the
-// web browser.
-func (s *DgraphStore) Save(r *http.Request, w http.ResponseWriter,
-	session *sessions.Session) error {
-	// Delete if max-age is <= 0
-	if session.Options.MaxAge <= 0 {
-		if err := s.erase(session); err != nil {
+// A session bound to a user gets an owner edge to the User node with a
+// matching userid, which is created if needed.
+func (b *DgraphBackend) Save(ctx context.Context, rec *Record) error {
+	return b.upsert(ctx, rec.ID, rec)
+}
+
+// Rename implements Renamer by changing the sessionid of the existing
+// Session node in a single upsert.
+func (b *DgraphBackend) Rename(ctx context.Context, oldID string, rec *Record) error {
+	return b.upsert(ctx, oldID, rec)
+}
+
+// dgraphDeleteNodes is a JSON deletion removing every predicate of the Session
+// nodes in variable v and of their SessionValue nodes in variable c.
+var dgraphDeleteNodes = []byte(`[{"uid": "uid(v)"}, {"uid": "uid(c)"}]`)
+
+// upsert writes rec to the Session node stored under matchID, creating it if
+// needed. With a non-zero rec.Version, only the node with that version is
+// replaced and none is created. The version is read in the transaction, so a
+// concurrent write aborts it.
+func (b *DgraphBackend) upsert(ctx context.Context, matchID string, rec *Record) error {
+	txn := b.db.NewTxn()
+	defer txn.Discard(ctx)
+
+	stored, err := b.version(ctx, txn, matchID)
+	if err != nil {
+		return err
+	}
+	if rec.Version != 0 && (stored == nil || stored.Version != rec.Version) {
+		return ErrConcurrentModification
+	}
+	version := int64(1)
+	if stored != nil {
+		version = stored.Version + 1
+	}
+
+	vars := map[string]string{"$id": matchID}
+	query := `query q($id: string) {
+		  q(func: eq(sessionid, $id)) {
+			v as uid
+			sessionvalues {
+			  c as uid
+			}
+		  }
+}`
+	if rec.UserID != "" {
+		if err := b.ensureUser(ctx, txn, rec.UserID); err != nil {
 			return err
 		}
-		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
-		return nil
+
+		vars["$userid"] = rec.UserID
+		query = `query q($id: string, $userid: string) {
+		  q(func: eq(sessionid, $id)) {
+			v as uid
+			sessionvalues {
+			  c as uid
+			}
+		  }
+		  u as var(func: eq(userid, $userid))
+}`
+	}
+
+	// Previous values are dropped, whichever way they were stored.
+	drop := map[string]interface{}{
+		"uid":           "uid(v)",
+		"owner":         nil,
+		"sessionvalues": nil,
 	}
 
-	if session.ID == "" {
-		session.ID = strings.TrimRight(
-			base32.StdEncoding.EncodeToString(
-				securecookie.GenerateRandomKey(32)), "=")
+	var values []map[string]interface{}
+	if rec.Values != nil {
+		if values, err = dgraphValueNodes(rec.Values); err != nil {
+			return err
+		}
+		drop["sessionvalue"] = nil
+	}
+
+	node := func(uid string) map[string]interface{} {
+		n := map[string]interface{}{
+			"uid":         uid,
+			"dgraph.type": "Session",
+			"sessionid":   rec.ID,
+			"sessionname": rec.Name,
+			"updated":     dgraphTime(rec.Updated),
+			"expiresat":   dgraphTime(rec.ExpiresAt),
+			"version":     version,
+		}
+		if rec.Values != nil {
+			n["sessionvalues"] = values
+		} else {
+			n["sessionvalue"] = dgraphEncodeValue(rec.Value)
+		}
+		if rec.UserID != "" {
+			n["owner"] = map[string]string{"uid": "uid(u)"}
+		}
+		return n
 	}
 
-	if err := s.save(session); err != nil {
+	remove, err := json.Marshal([]map[string]interface{}{{"uid": "uid(c)"}, drop})
+	if err != nil {
 		return err
 	}
 
-	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID,
-		s.Codecs...)
+	// The creation time is only written when the session node is created.
+	created := node("_:session")
+	created["created"] = dgraphTime(rec.Created)
+	create, err := json.Marshal(created)
 	if err != nil {
 		return err
 	}
 
-	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
-	return nil
-}
+	update, err := json.Marshal(node("uid(v)"))
+	if err != nil {
+		return err
+	}
 
-// MaxAge sets the maximum age for the store and the underlying cookie
-// implementation. Individual sessions can be deleted by setting Options.MaxAge
-// = -1 for that session.
-func (s *DgraphStore) MaxAge(age int) {
-	s.Options.MaxAge = age
+	req := &api.Request{
+		Query: query,
+		Vars:  vars,
+		Mutations: []*api.Mutation{
+			{
+				Cond:    `@if(eq(len(v), 0))`,
+				SetJson: create,
+			},
+			{
+				// Drop the previous owner and values before setting the current ones.
+				Cond:       `@if(gt(len(v), 0))`,
+				DeleteJson: remove,
+			},
+			{
+				Cond:    `@if(gt(len(v), 0))`,
+				SetJson: update,
+			},
+		},
+		CommitNow: true,
+	}
 
-	// Set the maxAge for each securecookie instance.
-	for _, codec := range s.Codecs {
-		if sc, ok := codec.(*securecookie.SecureCookie); ok {
-			sc.MaxAge(age)
+	if _, err := txn.Do(ctx, req); err != nil {
+		if err == dgo.ErrAborted {
+			return ErrConcurrentModification
 		}
+		return err
 	}
+
+	rec.Version = version
+	return nil
 }
 
-// Session represents a custom Type in Dgraph
-type Session struct {
-	Uid          string   `json:"uid,omitempty"`
-	DType        []string `json:"dgraph.type,omitempty"`
-	SessionID    string   `json:"sessionid,omitempty"`
-	SessionValue string   `json:"sessionvalue,omitempty"`
+// version reads the Session node stored under id in txn, nil if there is none.
+func (b *DgraphBackend) version(ctx context.Context, txn *dgo.Txn, id string) (*Session, error) {
+	query := `query q($id: string) {
+	q(func: eq(sessionid, $id)) {
+	  uid
+	  version
+	}
+}`
+
+	response, err := txn.QueryWithVars(ctx, query, map[string]string{"$id": id})
+	if err != nil {
+		return nil, err
+	}
+
+	var r struct {
+		Q []Session `json:"q"`
+	}
+
+	err = json.Unmarshal(response.Json, &r)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(r.Q) == 0 {
+		return nil, nil
+	}
+	return &r.Q[0], nil
 }
 
-func (s *DgraphStore) save(session *sessions.Session) error {
-	ctx := context.Background()
+// ensureUser creates the User node for userID in txn if it does not exist yet.
+// It relies on the @upsert directive of userid in the schema: without it,
+// concurrent first saves for a user would each create a node.
+func (b *DgraphBackend) ensureUser(ctx context.Context, txn *dgo.Txn, userID string) error {
+	query := `query q($userid: string) {
+		  u as var(func: eq(userid, $userid))
+}`
 
-	encoded, err := securecookie.EncodeMulti(session.Name(), session.Values,
-		s.Codecs...)
+	mutation, err := json.Marshal(User{
+		Uid:    "_:user",
+		DType:  []string{"User"},
+		UserID: userID,
+	})
 	if err != nil {
 		return err
 	}
 
-	query := `{
-		  q(func: eq(sessionid, "` + session.ID + `")) {
+	req := &api.Request{
+		Query: query,
+		Vars:  map[string]string{"$userid": userID},
+		Mutations: []*api.Mutation{
+			{
+				Cond:    `@if(eq(len(u), 0))`,
+				SetJson: mutation,
+			},
+		},
+	}
+
+	_, err = txn.Do(ctx, req)
+
+	return err
+}
+
+// Load implements Backend.
+func (b *DgraphBackend) Load(ctx context.Context, id string) (*Record, error) {
+	query := `query q($id: string) {
+	q(func: eq(sessionid, $id)) {
+	  sessionvalue` + dgraphSessionFields + dgraphValueFields + `
+	}
+}`
+
+	response, err := b.db.NewReadOnlyTxn().QueryWithVars(ctx, query, map[string]string{"$id": id})
+	if err != nil {
+		return nil, err
+	}
+
+	var r struct {
+		Q []Session `json:"q"`
+	}
+
+	err = json.Unmarshal(response.Json, &r)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(r.Q) == 0 || r.Q[0].SessionID == "" {
+		return nil, ErrSessionNotFound
+	}
+
+	rec := r.Q[0].record()
+	if r.Q[0].SessionValue == "" {
+		// Saved with NativeValues.
+		if rec.Values, err = dgraphDecodeValues(r.Q[0].SessionValues); err != nil {
+			return nil, err
+		}
+	}
+	return rec, nil
+}
+
+// Touch implements Toucher, setting the updated and expiresat predicates only.
+func (b *DgraphBackend) Touch(ctx context.Context, id string, updated, expiresAt time.Time) error {
+	query := `query q($id: string) {
+		  q(func: eq(sessionid, $id)) {
 			v as uid
 		  }
 }`
 
-	mutation := `
-	uid(v) <sessionid> "` + session.ID + `" .
-	uid(v) <sessionvalue> "` + encoded + `" .
-	uid(v) <dgraph.type> "Session" .`
+	mutation, err := json.Marshal(map[string]string{
+		"uid":       "uid(v)",
+		"updated":   dgraphTime(updated),
+		"expiresat": dgraphTime(expiresAt),
+	})
+	if err != nil {
+		return err
+	}
 
 	req := &api.Request{
 		Query: query,
+		Vars:  map[string]string{"$id": id},
 		Mutations: []*api.Mutation{
 			{
-				SetNquads: []byte(mutation),
+				Cond:    `@if(gt(len(v), 0))`,
+				SetJson: mutation,
 			},
 		},
 		CommitNow: true,
 	}
 
-	_, err = s.db.NewTxn().Do(ctx, req)
+	response, err := b.db.NewTxn().Do(ctx, req)
+	if err != nil {
+		return err
+	}
 
-	return err
-}
+	var r struct {
+		Q []Session `json:"q"`
+	}
 
-func (s *DgraphStore) load(session *sessions.Session) error {
-	ctx := context.Background()
+	err = json.Unmarshal(response.Json, &r)
+	if err != nil {
+		return err
+	}
 
-	query := `{
-	q(func: eq(sessionid, "` + session.ID + `")) {
-	  sessionvalue
+	if len(r.Q) == 0 {
+		return ErrSessionNotFound
 	}
+	return nil
+}
+
+// Delete implements Backend.
+func (b *DgraphBackend) Delete(ctx context.Context, id string) error {
+	query := `query q($id: string) {
+		  q(func: eq(sessionid, $id)) {
+			v as uid
+			sessionvalues {
+			  c as uid
+			}
+		  }
 }`
 
-	request := &api.Request{
-		Query:     query,
+	req := &api.Request{
+		Query: query,
+		Vars:  map[string]string{"$id": id},
+		Mutations: []*api.Mutation{
+			{
+				DeleteJson: dgraphDeleteNodes,
+			},
+		},
 		CommitNow: true,
 	}
 
-	response, err := s.db.NewTxn().Do(ctx, request)
+	_, err := b.db.NewTxn().Do(ctx, req)
+
+	return err
+}
+
+// List implements Lister with a paginated query over Session nodes.
+// Sessions are ordered by node and the cursor is the uid of the last node of a page.
+func (b *DgraphBackend) List(ctx context.Context, opts ListOptions) ([]SessionInfo, string, error) {
+	limit := opts.limit()
+	vars := map[string]string{
+		"$first": strconv.Itoa(limit + 1),
+		"$now":   dgraphTime(time.Now()),
+	}
+	params := []string{"$first: int", "$now: string"}
+	filters := []string{"gt(expiresat, $now)"}
+
+	// filter adds a filter on a query variable, declared only when used.
+	filter := func(name, value, fn string) {
+		vars[name] = value
+		params = append(params, name+": string")
+		filters = append(filters, fn)
+	}
+	if opts.Name != "" {
+		filter("$name", opts.Name, "eq(sessionname, $name)")
+	}
+	if !opts.CreatedAfter.IsZero() {
+		filter("$createdafter", dgraphTime(opts.CreatedAfter), "gt(created, $createdafter)")
+	}
+	if !opts.CreatedBefore.IsZero() {
+		filter("$createdbefore", dgraphTime(opts.CreatedBefore), "lt(created, $createdbefore)")
+	}
+	if !opts.UpdatedAfter.IsZero() {
+		filter("$updatedafter", dgraphTime(opts.UpdatedAfter), "gt(updated, $updatedafter)")
+	}
+	if !opts.UpdatedBefore.IsZero() {
+		filter("$updatedbefore", dgraphTime(opts.UpdatedBefore), "lt(updated, $updatedbefore)")
+	}
+
+	page := "first: $first"
+	if opts.Cursor != "" {
+		vars["$after"] = opts.Cursor
+		params = append(params, "$after: string")
+		page += ", after: $after"
+	}
+
+	query := `query q(` + strings.Join(params, ", ") + `) {
+	q(func: type(Session), ` + page + `) @filter(` + strings.Join(filters, " AND ") + `) {
+	  uid` + dgraphSessionFields + `
+	}
+}`
+
+	response, err := b.db.NewReadOnlyTxn().QueryWithVars(ctx, query, vars)
 	if err != nil {
-		return err
+		return nil, "", err
 	}
 
 	var r struct {
@@ -264,38 +715,118 @@ func (s *DgraphStore) load(session *sessions.Session) error {
 
 	err = json.Unmarshal(response.Json, &r)
 	if err != nil {
-		return err
+		return nil, "", err
+	}
+
+	var next string
+	if len(r.Q) > limit {
+		r.Q = r.Q[:limit]
+		next = r.Q[limit-1].Uid
 	}
 
-	if len(r.Q[0].SessionValue) == 0 {
-		return errors.New("no key found")
+	infos := make([]SessionInfo, 0, len(r.Q))
+	for _, q := range r.Q {
+		infos = append(infos, q.record().info())
 	}
 
-	return securecookie.DecodeMulti(session.Name(), r.Q[0].SessionValue, &session.Values, s.Codecs...)
+	return infos, next, nil
 }
 
-func (s *DgraphStore) erase(session *sessions.Session) error {
-	ctx := context.Background()
+// ListByUser implements UserIndexer by following the reverse owner edges of the User node.
+func (b *DgraphBackend) ListByUser(ctx context.Context, userID string) ([]SessionInfo, error) {
+	query := `query q($userid: string, $now: string) {
+	q(func: eq(userid, $userid)) {
+	  ~owner @filter(gt(expiresat, $now)) {` + dgraphSessionFields + `
+	  }
+	}
+}`
 
-	query := `{
-		  q(func: eq(sessionid, "` + session.ID + `")) {
-			v as uid
+	vars := map[string]string{
+		"$userid": userID,
+		"$now":    dgraphTime(time.Now()),
+	}
+
+	response, err := b.db.NewReadOnlyTxn().QueryWithVars(ctx, query, vars)
+	if err != nil {
+		return nil, err
+	}
+
+	var r struct {
+		Q []User `json:"q"`
+	}
+
+	err = json.Unmarshal(response.Json, &r)
+	if err != nil {
+		return nil, err
+	}
+
+	var infos []SessionInfo
+	for _, u := range r.Q {
+		for _, q := range u.Sessions {
+			infos = append(infos, q.record().info())
+		}
+	}
+
+	return infos, nil
+}
+
+// DeleteByUser implements UserIndexer, deleting all Session nodes owned by the User node in one upsert.
+func (b *DgraphBackend) DeleteByUser(ctx context.Context, userID string) error {
+	query := `query q($userid: string) {
+		  q(func: eq(userid, $userid)) {
+			~owner {
+			  v as uid
+			  sessionvalues {
+				c as uid
+			  }
+			}
 		  }
 }`
 
-	deletion := `uid(v) * * . `
+	req := &api.Request{
+		Query: query,
+		Vars:  map[string]string{"$userid": userID},
+		Mutations: []*api.Mutation{
+			{
+				DeleteJson: dgraphDeleteNodes,
+			},
+		},
+		CommitNow: true,
+	}
+
+	_, err := b.db.NewTxn().Do(ctx, req)
+
+	return err
+}
+
+// reap deletes every Session node whose expiresat lies in the past, and
+// the SessionLock nodes of expired leases.
+func (b *DgraphBackend) reap(ctx context.Context) error {
+	query := `query q($now: string) {
+		  q(func: lt(expiresat, $now)) @filter(type(Session)) {
+			v as uid
+			sessionvalues {
+			  c as uid
+			}
+		  }
+		  l as var(func: lt(lockexpires, $now))
+}`
 
 	req := &api.Request{
 		Query: query,
+		Vars:  map[string]string{"$now": dgraphTime(time.Now())},
 		Mutations: []*api.Mutation{
 			{
-				DelNquads: []byte(deletion),
+				DeleteJson: dgraphDeleteNodes,
+			},
+			{
+				DeleteJson: []byte(`{"uid": "uid(l)"}`),
 			},
 		},
 		CommitNow: true,
 	}
 
-	_, err := s.db.NewTxn().Do(ctx, req)
+	_, err := b.db.NewTxn().Do(ctx, req)
 
 	return err
 }
@@ -0,0 +1,361 @@
+package vagorillasessionsstores
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bh90210/vagorillasessionsstores/storetest"
+	"github.com/gorilla/sessions"
+	"google.golang.org/grpc"
+)
+
+// newTestDgraphStore returns a DgraphStore on a fakeDgraph, with its schema.
+func newTestDgraphStore(t *testing.T) *DgraphStore {
+	store, err := NewDgraphStoreWithSchema(newFakeDgraph(t), []byte("some key"))
+	if err != nil {
+		t.Fatal("failed to create store", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// Test DgraphStore against the conformance suite, on a fakeDgraph unless
+// DGRAPH_ADDR is set to the address of a Dgraph server whose schema it may
+// alter, e.g. DGRAPH_ADDR=127.0.0.1:9080.
+func TestDgraphStoreConformance(t *testing.T) {
+	var store *DgraphStore
+	if addr := os.Getenv("DGRAPH_ADDR"); addr != "" {
+		conn, err := grpc.Dial(addr, grpc.WithInsecure())
+		if err != nil {
+			t.Fatal("failed to connect to Dgraph", err)
+		}
+		defer conn.Close()
+
+		store, err = NewDgraphStoreWithSchema(conn, []byte("some key"))
+		if err != nil {
+			t.Fatal("failed to create store", err)
+		}
+		defer store.Close()
+	} else {
+		store = newTestDgraphStore(t)
+	}
+
+	storetest.RunConformance(t, func(t *testing.T, keyPairs ...[]byte) sessions.Store {
+		return NewStore(store.backend, keyPairs...)
+	})
+}
+
+// Test a dgraph session round trip through http
+func TestDgraphStore(t *testing.T) {
+	store := newTestDgraphStore(t)
+
+	req, err := http.NewRequest("GET", "http://www.example.com", nil)
+	if err != nil {
+		t.Fatal("failed to create request", err)
+	}
+	session, err := store.New(req, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	session.Values["foo"] = "bar"
+	session.Values["bin"] = []byte{0xff, 0x00}
+
+	w := httptest.NewRecorder()
+	if err := session.Save(req, w); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	req.Header.Add("Cookie", w.Header().Get("Set-Cookie"))
+
+	session, err = store.New(req, "hello")
+	if err != nil {
+		t.Fatal("failed to load session", err)
+	}
+	if session.IsNew || session.Values["foo"] != "bar" || string(session.Values["bin"].([]byte)) != "\xff\x00" {
+		t.Fatalf("session not loaded: IsNew %v, values %v", session.IsNew, session.Values)
+	}
+
+	session.Options.MaxAge = -1
+	if err := session.Save(req, httptest.NewRecorder()); err != nil {
+		t.Fatal("failed to delete session", err)
+	}
+	if ok, err := store.Exists(context.Background(), session.ID); err != nil || ok {
+		t.Fatalf("session not deleted: exists %v, %v", ok, err)
+	}
+}
+
+// Test listing, revoking and renaming the dgraph sessions of users
+func TestDgraphStoreUsers(t *testing.T) {
+	store := newTestDgraphStore(t)
+
+	ctx := context.Background()
+	var ids []string
+	for _, userID := range []string{"alice", "alice", "bob"} {
+		session := sessions.NewSession(store, "hello")
+		session.Options = &sessions.Options{MaxAge: 60}
+		SetUserID(session, userID)
+		if err := store.SaveByID(ctx, session); err != nil {
+			t.Fatal("failed to save session", err)
+		}
+		ids = append(ids, session.ID)
+	}
+
+	infos, next, err := store.List(ctx, ListOptions{Limit: 2})
+	if err != nil {
+		t.Fatal("failed to list sessions", err)
+	}
+	if len(infos) != 2 || next == "" {
+		t.Fatalf("bad first page: %d sessions, next %q", len(infos), next)
+	}
+	infos, next, err = store.List(ctx, ListOptions{Limit: 2, Cursor: next})
+	if err != nil {
+		t.Fatal("failed to list sessions", err)
+	}
+	if len(infos) != 1 || next != "" {
+		t.Fatalf("bad last page: %d sessions, next %q", len(infos), next)
+	}
+
+	infos, err = store.ListSessionsForUser(ctx, "alice")
+	if err != nil {
+		t.Fatal("failed to list sessions", err)
+	}
+	if len(infos) != 2 || infos[0].UserID != "alice" {
+		t.Fatalf("expected 2 sessions of alice, got %+v", infos)
+	}
+
+	req, err := http.NewRequest("GET", "http://www.example.com", nil)
+	if err != nil {
+		t.Fatal("failed to create request", err)
+	}
+	session, err := store.LoadByID(ctx, "hello", ids[0])
+	if err != nil {
+		t.Fatal("failed to load session", err)
+	}
+	if err := store.RegenerateID(req, httptest.NewRecorder(), session); err != nil {
+		t.Fatal("failed to regenerate session ID", err)
+	}
+	if ok, _ := store.Exists(ctx, ids[0]); ok {
+		t.Fatal("old session not deleted")
+	}
+	if _, err := store.LoadByID(ctx, "hello", session.ID); err != nil {
+		t.Fatal("failed to load renamed session", err)
+	}
+
+	if err := store.RevokeAllForUser(ctx, "alice"); err != nil {
+		t.Fatal("failed to revoke sessions", err)
+	}
+	for i, id := range []string{session.ID, ids[1], ids[2]} {
+		ok, err := store.Exists(ctx, id)
+		if err != nil {
+			t.Fatal("failed to check session", err)
+		}
+		if ok != (i == 2) {
+			t.Fatalf("session %d: exists %v", i, ok)
+		}
+	}
+}
+
+// Test graph-native values and the sessions linked to a node
+func TestDgraphStoreNativeValues(t *testing.T) {
+	store := newTestDgraphStore(t)
+	store.SetNativeValues(true)
+
+	ctx := context.Background()
+	session := sessions.NewSession(store, "hello")
+	session.Options = &sessions.Options{MaxAge: 60}
+	session.Values["name"] = "alice"
+	session.Values["count"] = 3
+	session.Values["cart"] = DgraphNode{Uid: "0x2a"}
+	if err := store.SaveByID(ctx, session); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+
+	delete(session.Values, "name")
+	session.Values["count"] = 4
+	if err := store.SaveByID(ctx, session); err != nil {
+		t.Fatal("failed to save session again", err)
+	}
+
+	loaded, err := store.LoadByID(ctx, "hello", session.ID)
+	if err != nil {
+		t.Fatal("failed to load session", err)
+	}
+	if _, ok := loaded.Values["name"]; ok || loaded.Values["count"] != 4 || loaded.Values["cart"] != (DgraphNode{Uid: "0x2a"}) {
+		t.Fatalf("session not loaded: %v", loaded.Values)
+	}
+
+	infos, err := store.SessionsForNode(ctx, "0x2a")
+	if err != nil {
+		t.Fatal("failed to find sessions", err)
+	}
+	if len(infos) != 1 || infos[0].ID != session.ID {
+		t.Fatalf("expected the session linked to the cart, got %+v", infos)
+	}
+}
+
+// Test that a dgraph session saved concurrently since it was loaded is not overwritten
+func TestDgraphStoreConcurrentModification(t *testing.T) {
+	store := newTestDgraphStore(t)
+
+	ctx := context.Background()
+	session := sessions.NewSession(store, "hello")
+	session.Options = &sessions.Options{MaxAge: 60}
+	if err := store.SaveByID(ctx, session); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+
+	first, err := store.LoadByID(ctx, "hello", session.ID)
+	if err != nil {
+		t.Fatal("failed to load session", err)
+	}
+	second, err := store.LoadByID(ctx, "hello", session.ID)
+	if err != nil {
+		t.Fatal("failed to load session", err)
+	}
+
+	first.Values["a"] = "1"
+	if err := store.SaveByID(ctx, first); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	second.Values["b"] = "2"
+	if err := store.SaveByID(ctx, second); !errors.Is(err, ErrConcurrentModification) {
+		t.Fatalf("expected ErrConcurrentModification, got %v", err)
+	}
+}
+
+// Test touching, locking and reaping dgraph sessions
+func TestDgraphStoreTouchLockReap(t *testing.T) {
+	store := newTestDgraphStore(t)
+
+	ctx := context.Background()
+	session := sessions.NewSession(store, "hello")
+	session.Options = &sessions.Options{MaxAge: 1}
+	if err := store.SaveByID(ctx, session); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	if err := store.Touch(ctx, session); err != nil {
+		t.Fatal("failed to touch session", err)
+	}
+	missing := sessions.NewSession(store, "hello")
+	missing.ID = "missing"
+	if err := store.Touch(ctx, missing); err != ErrSessionNotFound {
+		t.Fatalf("expected ErrSessionNotFound, got %v", err)
+	}
+
+	lock, err := store.Lock(ctx, session.ID, time.Second)
+	if err != nil {
+		t.Fatal("failed to lock session", err)
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel()
+	if _, err := store.Lock(waitCtx, session.ID, time.Second); err != context.DeadlineExceeded {
+		t.Fatalf("expected the second lock to time out, got %v", err)
+	}
+	if err := lock.Unlock(ctx); err != nil {
+		t.Fatal("failed to unlock session", err)
+	}
+	if _, err := store.Lock(ctx, session.ID, time.Second); err != nil {
+		t.Fatal("failed to lock unlocked session", err)
+	}
+
+	// Both the session and the lock expire.
+	time.Sleep(1100 * time.Millisecond)
+	if err := store.backend.reap(ctx); err != nil {
+		t.Fatal("failed to reap sessions", err)
+	}
+	response, err := store.backend.db.NewReadOnlyTxn().Query(ctx, `{
+	q(func: has(dgraph.type)) {
+	  uid
+	}
+}`)
+	if err != nil {
+		t.Fatal("failed to query nodes", err)
+	}
+	if string(response.Json) != `{"q":[]}` {
+		t.Fatalf("expected no nodes left, got %s", response.Json)
+	}
+}
+
+// Test that concurrent first saves for a user create a single User node
+func TestDgraphStoreUsersConcurrent(t *testing.T) {
+	store := newTestDgraphStore(t)
+	ctx := context.Background()
+
+	for round := 0; round < 20; round++ {
+		userID := newSessionID()
+
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				session := sessions.NewSession(store, "hello")
+				session.Options = &sessions.Options{MaxAge: 60}
+				SetUserID(session, userID)
+				if err := store.SaveByID(ctx, session); err != nil && !errors.Is(err, ErrConcurrentModification) {
+					t.Error("failed to save session", err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		response, err := store.backend.db.NewReadOnlyTxn().QueryWithVars(ctx, `query q($userid: string) {
+	q(func: eq(userid, $userid)) {
+	  uid
+	}
+}`, map[string]string{"$userid": userID})
+		if err != nil {
+			t.Fatal("failed to query users", err)
+		}
+		var r struct{ Q []User }
+		if err := json.Unmarshal(response.Json, &r); err != nil {
+			t.Fatal("failed to decode users", err)
+		}
+		if len(r.Q) != 1 {
+			t.Fatalf("round %d: %d User nodes", round, len(r.Q))
+		}
+	}
+}
+
+// Test that concurrent attempts at the first lock of a session have a single winner
+func TestDgraphBackendTryLockConcurrent(t *testing.T) {
+	store := newTestDgraphStore(t)
+	ctx := context.Background()
+
+	for round := 0; round < 20; round++ {
+		id := newSessionID()
+
+		var wg sync.WaitGroup
+		won := make(chan string, 8)
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				token := newSessionID()
+				acquired, err := store.backend.TryLock(ctx, id, token, time.Minute)
+				if err != nil {
+					t.Error("failed to lock session", err)
+				}
+				if acquired {
+					won <- token
+				}
+			}()
+		}
+		wg.Wait()
+		close(won)
+
+		if len(won) != 1 {
+			t.Fatalf("round %d: %d holders of the lock", round, len(won))
+		}
+		acquired, err := store.backend.TryLock(ctx, id, <-won, time.Minute)
+		if err != nil || !acquired {
+			t.Fatalf("round %d: the holder cannot extend the lock: %v %v", round, acquired, err)
+		}
+	}
+}
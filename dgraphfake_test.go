@@ -0,0 +1,1147 @@
+package vagorillasessionsstores
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode"
+
+	"github.com/dgraph-io/dgo/v200/protos/api"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// newFakeDgraph starts a fakeDgraph served over an in-memory connection and
+// returns a connection to it. Both are closed when the test ends.
+func newFakeDgraph(t *testing.T) *grpc.ClientConn {
+	lis := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	api.RegisterDgraphServer(server, &fakeDgraph{
+		graph:   make(fakeGraph),
+		types:   make(map[string]string),
+		lists:   map[string]bool{"dgraph.type": true},
+		upserts: make(map[string]bool),
+		written: make(map[fakeKey]uint64),
+		txns:    make(map[uint64]*fakeTxn),
+	})
+	go server.Serve(lis)
+
+	conn, err := grpc.Dial("bufconn",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+			return lis.Dial()
+		}),
+		grpc.WithInsecure())
+	if err != nil {
+		t.Fatal("failed to connect to fake Dgraph", err)
+	}
+
+	t.Cleanup(func() {
+		conn.Close()
+		server.Stop()
+	})
+	return conn
+}
+
+// fakeDgraph is an in-process api.DgraphServer keeping a graph in memory.
+// It understands the subset of DQL sent by DgraphBackend: query variables,
+// eq, lt, gt, type, uid and has functions and filters, uid variables,
+// nested and reverse edges, pagination, JSON mutations in upsert blocks with
+// @if conditions and schema alters. Transactions see a snapshot of the
+// graph and abort on commit if another one wrote the same predicate of a
+// node, or the same value of an @upsert predicate, in the meantime.
+type fakeDgraph struct {
+	api.UnimplementedDgraphServer
+
+	mu    sync.Mutex
+	graph fakeGraph
+	// types holds the types of the predicates declared by schema alters,
+	// lists the predicates holding lists, declared or set as JSON arrays.
+	types   map[string]string
+	lists   map[string]bool
+	// upserts holds the predicates declared with @upsert.
+	upserts map[string]bool
+	lastUid uint64
+	lastTs  uint64
+	// written holds the commit timestamp of the last write to each key.
+	written map[fakeKey]uint64
+	txns    map[uint64]*fakeTxn
+}
+
+// fakeGraph holds the values of the nodes of a graph by uid and predicate.
+// Edges are fakeUid values.
+type fakeGraph map[uint64]map[string][]interface{}
+
+// fakeUid is the value of an edge.
+type fakeUid uint64
+
+// fakeKey is a predicate of a node, the unit of transaction conflicts, or
+// the index entry of a value of an @upsert predicate.
+type fakeKey struct {
+	uid   uint64
+	pred  string
+	value string
+}
+
+// fakeTxn is a pending transaction: a snapshot of the graph with its writes
+// applied, and the writes to replay on commit.
+type fakeTxn struct {
+	startTs uint64
+	graph   fakeGraph
+	writes  []fakeWrite
+	keys    map[fakeKey]bool
+	upserts map[string]bool
+}
+
+// fakeWrite sets or deletes a value of a node. Deleting a nil value deletes
+// all the values of the predicate, deleting predicate "*" all predicates.
+type fakeWrite struct {
+	del   bool
+	uid   uint64
+	pred  string
+	value interface{}
+	list  bool
+}
+
+// clone returns a deep copy of g.
+func (g fakeGraph) clone() fakeGraph {
+	c := make(fakeGraph, len(g))
+	for uid, preds := range g {
+		cp := make(map[string][]interface{}, len(preds))
+		for pred, values := range preds {
+			cp[pred] = append([]interface{}(nil), values...)
+		}
+		c[uid] = cp
+	}
+	return c
+}
+
+// apply applies w to g.
+func (g fakeGraph) apply(w fakeWrite) {
+	preds := g[w.uid]
+	switch {
+	case !w.del:
+		if preds == nil {
+			preds = make(map[string][]interface{})
+			g[w.uid] = preds
+		}
+		if !w.list {
+			preds[w.pred] = []interface{}{w.value}
+			return
+		}
+		for _, v := range preds[w.pred] {
+			if v == w.value {
+				return
+			}
+		}
+		preds[w.pred] = append(preds[w.pred], w.value)
+	case w.pred == "*":
+		delete(g, w.uid)
+	case w.value == nil:
+		delete(preds, w.pred)
+	default:
+		var kept []interface{}
+		for _, v := range preds[w.pred] {
+			if v != w.value {
+				kept = append(kept, v)
+			}
+		}
+		if len(kept) == 0 {
+			delete(preds, w.pred)
+		} else {
+			preds[w.pred] = kept
+		}
+	}
+	if preds != nil && len(preds) == 0 {
+		delete(g, w.uid)
+	}
+}
+
+// Alter implements api.DgraphServer, recording the predicates of the schema.
+func (f *fakeDgraph) Alter(ctx context.Context, op *api.Operation) (*api.Payload, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if op.DropAll {
+		f.graph = make(fakeGraph)
+		f.types = make(map[string]string)
+		f.lists = map[string]bool{"dgraph.type": true}
+		f.upserts = make(map[string]bool)
+	}
+
+	inType := false
+	for _, line := range strings.Split(op.Schema, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "type "):
+			inType = !strings.HasSuffix(line, "}")
+		case inType:
+			inType = line != "}"
+		default:
+			m := fakeSchemaLine.FindStringSubmatch(line)
+			if m == nil {
+				return nil, status.Errorf(codes.InvalidArgument, "bad schema line %q", line)
+			}
+			f.types[m[1]] = m[3]
+			f.lists[m[1]] = m[2] == "["
+			f.upserts[m[1]] = strings.Contains(line, "@upsert")
+		}
+	}
+	return &api.Payload{}, nil
+}
+
+// fakeSchemaLine matches a predicate declaration such as "owner: [uid] @reverse .".
+var fakeSchemaLine = regexp.MustCompile(`^([\w.]+)\s*:\s*(\[?)(\w+)\]?[^.]*\.$`)
+
+// Query implements api.DgraphServer: it runs the query of req, then its
+// mutations, and commits the transaction if req.CommitNow is set.
+func (f *fakeDgraph) Query(ctx context.Context, req *api.Request) (*api.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var txn *fakeTxn
+	view := f.graph
+	if !req.ReadOnly {
+		var err error
+		if txn, err = f.txn(req.StartTs); err != nil {
+			return nil, err
+		}
+		view = txn.graph
+	}
+
+	q := &fakeQuery{graph: view, lists: f.lists, vars: make(map[string][]uint64)}
+	result := make(map[string]interface{})
+	if req.Query != "" {
+		blocks, err := parseFakeQuery(req.Query, req.Vars)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		for _, b := range blocks {
+			nodes := q.run(b)
+			if b.name != "var" {
+				result[b.name] = nodes
+			}
+		}
+	}
+	vars := q.vars
+
+	uids := make(map[string]string)
+	for _, mu := range req.Mutations {
+		if txn == nil {
+			return nil, status.Error(codes.InvalidArgument, "mutation in a read-only transaction")
+		}
+		if mu.Cond != "" {
+			ok, err := fakeCondition(mu.Cond, vars)
+			if err != nil {
+				return nil, status.Error(codes.InvalidArgument, err.Error())
+			}
+			if !ok {
+				continue
+			}
+		}
+		if err := f.mutate(txn, mu.DeleteJson, true, vars, uids); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		if err := f.mutate(txn, mu.SetJson, false, vars, uids); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		return nil, err
+	}
+	response := &api.Response{Json: data, Uids: uids}
+	if txn != nil {
+		response.Txn = &api.TxnContext{StartTs: txn.startTs}
+		if req.CommitNow {
+			if response.Txn.CommitTs, err = f.commit(txn); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return response, nil
+}
+
+// CommitOrAbort implements api.DgraphServer.
+func (f *fakeDgraph) CommitOrAbort(ctx context.Context, tc *api.TxnContext) (*api.TxnContext, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	txn, ok := f.txns[tc.StartTs]
+	if !ok {
+		return nil, status.Error(codes.NotFound, "unknown transaction")
+	}
+	if tc.Aborted {
+		delete(f.txns, tc.StartTs)
+		return &api.TxnContext{StartTs: tc.StartTs, Aborted: true}, nil
+	}
+
+	commitTs, err := f.commit(txn)
+	if err != nil {
+		return nil, err
+	}
+	return &api.TxnContext{StartTs: tc.StartTs, CommitTs: commitTs}, nil
+}
+
+// txn returns the transaction started at startTs, starting one if zero.
+func (f *fakeDgraph) txn(startTs uint64) (*fakeTxn, error) {
+	if startTs == 0 {
+		f.lastTs++
+		txn := &fakeTxn{
+			startTs: f.lastTs,
+			graph:   f.graph.clone(),
+			keys:    make(map[fakeKey]bool),
+			upserts: f.upserts,
+		}
+		f.txns[txn.startTs] = txn
+		return txn, nil
+	}
+
+	txn, ok := f.txns[startTs]
+	if !ok {
+		return nil, status.Error(codes.Aborted, "transaction has been aborted")
+	}
+	return txn, nil
+}
+
+// commit replays the writes of txn on the graph, or aborts it if another
+// transaction committed a write to one of its keys since it started.
+func (f *fakeDgraph) commit(txn *fakeTxn) (uint64, error) {
+	delete(f.txns, txn.startTs)
+	for key := range txn.keys {
+		if f.written[key] > txn.startTs {
+			return 0, status.Error(codes.Aborted, "transaction has been aborted")
+		}
+	}
+
+	f.lastTs++
+	for _, w := range txn.writes {
+		f.graph.apply(w)
+	}
+	for key := range txn.keys {
+		f.written[key] = f.lastTs
+	}
+	return f.lastTs, nil
+}
+
+// write applies w in txn.
+func (txn *fakeTxn) write(w fakeWrite) {
+	switch {
+	case w.del && w.pred == "*":
+		for pred, values := range txn.graph[w.uid] {
+			txn.keys[fakeKey{uid: w.uid, pred: pred}] = true
+			txn.index(pred, values...)
+		}
+	case w.value == nil:
+		txn.keys[fakeKey{uid: w.uid, pred: w.pred}] = true
+		txn.index(w.pred, txn.graph[w.uid][w.pred]...)
+	default:
+		txn.keys[fakeKey{uid: w.uid, pred: w.pred}] = true
+		txn.index(w.pred, w.value)
+	}
+	txn.graph.apply(w)
+	txn.writes = append(txn.writes, w)
+}
+
+// index records the index entries of values of pred written by txn, if pred
+// is declared with @upsert.
+func (txn *fakeTxn) index(pred string, values ...interface{}) {
+	if !txn.upserts[pred] {
+		return
+	}
+	for _, v := range values {
+		txn.keys[fakeKey{pred: pred, value: fmt.Sprint(v)}] = true
+	}
+}
+
+// mutate applies the JSON mutation data, an object or an array of objects, in txn.
+func (f *fakeDgraph) mutate(txn *fakeTxn, data []byte, del bool, vars map[string][]uint64, uids map[string]string) error {
+	if len(data) == 0 {
+		return nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return err
+	}
+
+	objects, ok := v.([]interface{})
+	if !ok {
+		objects = []interface{}{v}
+	}
+	for _, o := range objects {
+		obj, ok := o.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("mutation of a %T", o)
+		}
+		var err error
+		if del {
+			err = f.deleteObject(txn, obj, vars, uids)
+		} else {
+			_, err = f.setObject(txn, obj, vars, uids)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolve returns the nodes a mutation object refers to with its uid, new
+// nodes if create is set and it refers to none.
+func (f *fakeDgraph) resolve(uid interface{}, create bool, vars map[string][]uint64, uids map[string]string) ([]uint64, error) {
+	newNode := func() uint64 {
+		f.lastUid++
+		return f.lastUid
+	}
+
+	s, _ := uid.(string)
+	switch {
+	case uid == nil:
+		if !create {
+			return nil, fmt.Errorf("deletion without uid")
+		}
+		return []uint64{newNode()}, nil
+	case strings.HasPrefix(s, "_:"):
+		blank := strings.TrimPrefix(s, "_:")
+		if hex, ok := uids[blank]; ok {
+			n, _ := strconv.ParseUint(hex, 0, 64)
+			return []uint64{n}, nil
+		}
+		if !create {
+			return nil, nil
+		}
+		n := newNode()
+		uids[blank] = fmt.Sprintf("%#x", n)
+		return []uint64{n}, nil
+	case strings.HasPrefix(s, "uid(") && strings.HasSuffix(s, ")"):
+		nodes := vars[s[len("uid("):len(s)-1]]
+		if len(nodes) == 0 && create {
+			// Like Dgraph, set a new node for an empty variable.
+			return []uint64{newNode()}, nil
+		}
+		return nodes, nil
+	default:
+		n, err := strconv.ParseUint(s, 0, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad uid %q", s)
+		}
+		return []uint64{n}, nil
+	}
+}
+
+// setObject sets the values of a mutation object on the nodes it refers to
+// and returns them.
+func (f *fakeDgraph) setObject(txn *fakeTxn, obj map[string]interface{}, vars map[string][]uint64, uids map[string]string) ([]uint64, error) {
+	nodes, err := f.resolve(obj["uid"], true, vars, uids)
+	if err != nil {
+		return nil, err
+	}
+
+	for pred, v := range obj {
+		if pred == "uid" || v == nil {
+			continue
+		}
+
+		values := []interface{}{v}
+		if vs, ok := v.([]interface{}); ok {
+			values = vs
+			f.lists[pred] = true
+		}
+		list := f.lists[pred]
+		for _, value := range values {
+			var targets []interface{}
+			if child, ok := value.(map[string]interface{}); ok {
+				children, err := f.setObject(txn, child, vars, uids)
+				if err != nil {
+					return nil, err
+				}
+				for _, c := range children {
+					targets = append(targets, fakeUid(c))
+				}
+			} else {
+				scalar, err := f.scalar(pred, value)
+				if err != nil {
+					return nil, err
+				}
+				targets = append(targets, scalar)
+			}
+
+			for _, n := range nodes {
+				for _, target := range targets {
+					txn.write(fakeWrite{uid: n, pred: pred, value: target, list: list})
+				}
+			}
+		}
+	}
+	return nodes, nil
+}
+
+// deleteObject deletes the values of a mutation object from the nodes it
+// refers to, all their predicates if it only holds a uid.
+func (f *fakeDgraph) deleteObject(txn *fakeTxn, obj map[string]interface{}, vars map[string][]uint64, uids map[string]string) error {
+	nodes, err := f.resolve(obj["uid"], false, vars, uids)
+	if err != nil {
+		return err
+	}
+
+	for _, n := range nodes {
+		if len(obj) == 1 {
+			txn.write(fakeWrite{del: true, uid: n, pred: "*"})
+			continue
+		}
+
+		for pred, v := range obj {
+			if pred == "uid" {
+				continue
+			}
+			if v == nil {
+				txn.write(fakeWrite{del: true, uid: n, pred: pred})
+				continue
+			}
+
+			values, ok := v.([]interface{})
+			if !ok {
+				values = []interface{}{v}
+			}
+			for _, value := range values {
+				if child, ok := value.(map[string]interface{}); ok {
+					targets, err := f.resolve(child["uid"], false, vars, uids)
+					if err != nil {
+						return err
+					}
+					for _, target := range targets {
+						txn.write(fakeWrite{del: true, uid: n, pred: pred, value: fakeUid(target)})
+					}
+					continue
+				}
+				scalar, err := f.scalar(pred, value)
+				if err != nil {
+					return err
+				}
+				txn.write(fakeWrite{del: true, uid: n, pred: pred, value: scalar})
+			}
+		}
+	}
+	return nil
+}
+
+// scalar converts a JSON value to the type of pred in the schema.
+func (f *fakeDgraph) scalar(pred string, v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case json.Number:
+		switch f.types[pred] {
+		case "int":
+			return v.Int64()
+		case "float":
+			return v.Float64()
+		}
+		if n, err := v.Int64(); err == nil {
+			return n, nil
+		}
+		return v.Float64()
+	case string:
+		if f.types[pred] == "datetime" {
+			return time.Parse(time.RFC3339Nano, v)
+		}
+		return v, nil
+	case bool:
+		return v, nil
+	}
+	return nil, fmt.Errorf("predicate %s: unsupported value %v", pred, v)
+}
+
+// fakeBlock is a query block, or a field of one when it has no function.
+type fakeBlock struct {
+	name   string
+	as     string
+	fn     *fakeFunc
+	first  int
+	after  uint64
+	filter *fakeFilter
+	fields []*fakeBlock
+	body   bool
+}
+
+// fakeFunc is a function call, its arguments are strings or *fakeFunc.
+type fakeFunc struct {
+	name string
+	args []interface{}
+}
+
+// fakeFilter is a filter expression: a function, or "and", "or" and "not" of sub-filters.
+type fakeFilter struct {
+	op  string
+	fn  *fakeFunc
+	sub []*fakeFilter
+}
+
+// fakeQuery evaluates the blocks of a query on a graph.
+type fakeQuery struct {
+	graph fakeGraph
+	lists map[string]bool
+	// vars holds the nodes bound to uid variables by the blocks run so far.
+	vars map[string][]uint64
+}
+
+// run returns the output of block b, binding its variables.
+func (q *fakeQuery) run(b *fakeBlock) []interface{} {
+	var nodes []uint64
+	if b.fn.name == "uid" {
+		// Unknown uids are results too.
+		for _, arg := range b.fn.args {
+			nodes = append(nodes, q.uids(arg.(string))...)
+		}
+	} else {
+		for uid := range q.graph {
+			if q.match(uid, b.fn) {
+				nodes = append(nodes, uid)
+			}
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i] < nodes[j] })
+
+	var page []uint64
+	for _, uid := range nodes {
+		if uid <= b.after || !q.filter(uid, b.filter) {
+			continue
+		}
+		if b.first > 0 && len(page) == b.first {
+			break
+		}
+		page = append(page, uid)
+	}
+
+	if b.as != "" {
+		q.vars[b.as] = append(q.vars[b.as], page...)
+	}
+
+	out := make([]interface{}, 0, len(page))
+	for _, uid := range page {
+		if node := q.output(uid, b.fields); len(node) > 0 {
+			out = append(out, node)
+		}
+	}
+	return out
+}
+
+// output returns the requested fields of node uid.
+func (q *fakeQuery) output(uid uint64, fields []*fakeBlock) map[string]interface{} {
+	node := make(map[string]interface{})
+	for _, field := range fields {
+		switch {
+		case field.name == "uid":
+			node["uid"] = fmt.Sprintf("%#x", uid)
+			if field.as != "" {
+				q.vars[field.as] = append(q.vars[field.as], uid)
+			}
+
+		case field.body:
+			var targets []uint64
+			reverse := strings.HasPrefix(field.name, "~")
+			if reverse {
+				targets = q.reverse(uid, field.name[1:])
+			} else {
+				for _, v := range q.graph[uid][field.name] {
+					if target, ok := v.(fakeUid); ok {
+						targets = append(targets, uint64(target))
+					}
+				}
+			}
+
+			var children []interface{}
+			for _, target := range targets {
+				if !q.filter(target, field.filter) {
+					continue
+				}
+				if field.as != "" {
+					q.vars[field.as] = append(q.vars[field.as], target)
+				}
+				if child := q.output(target, field.fields); len(child) > 0 {
+					children = append(children, child)
+				}
+			}
+			switch {
+			case len(children) == 0:
+			case reverse || q.lists[field.name]:
+				node[field.name] = children
+			default:
+				node[field.name] = children[0]
+			}
+
+		default:
+			values := q.graph[uid][field.name]
+			switch {
+			case len(values) == 0:
+			case q.lists[field.name]:
+				node[field.name] = values
+			default:
+				node[field.name] = values[0]
+			}
+		}
+	}
+	return node
+}
+
+// reverse returns the nodes with a pred edge to uid.
+func (q *fakeQuery) reverse(uid uint64, pred string) []uint64 {
+	var nodes []uint64
+	for n, preds := range q.graph {
+		for _, v := range preds[pred] {
+			if v == fakeUid(uid) {
+				nodes = append(nodes, n)
+			}
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i] < nodes[j] })
+	return nodes
+}
+
+// uids returns the nodes named by the argument of a uid function, a uid or a variable.
+func (q *fakeQuery) uids(arg string) []uint64 {
+	if n, err := strconv.ParseUint(arg, 0, 64); err == nil {
+		return []uint64{n}
+	}
+	return q.vars[arg]
+}
+
+// filter reports whether node uid passes f.
+func (q *fakeQuery) filter(uid uint64, f *fakeFilter) bool {
+	if f == nil {
+		return true
+	}
+
+	switch f.op {
+	case "and":
+		for _, sub := range f.sub {
+			if !q.filter(uid, sub) {
+				return false
+			}
+		}
+		return true
+	case "or":
+		for _, sub := range f.sub {
+			if q.filter(uid, sub) {
+				return true
+			}
+		}
+		return false
+	case "not":
+		return !q.filter(uid, f.sub[0])
+	}
+	return q.match(uid, f.fn)
+}
+
+// match reports whether node uid satisfies the function fn.
+func (q *fakeQuery) match(uid uint64, fn *fakeFunc) bool {
+	args := make([]string, len(fn.args))
+	for i, arg := range fn.args {
+		args[i], _ = arg.(string)
+	}
+
+	switch fn.name {
+	case "uid":
+		for _, arg := range args {
+			for _, n := range q.uids(arg) {
+				if n == uid {
+					return true
+				}
+			}
+		}
+		return false
+	case "type":
+		for _, t := range q.graph[uid]["dgraph.type"] {
+			if t == args[0] {
+				return true
+			}
+		}
+		return false
+	case "has":
+		return len(q.graph[uid][args[0]]) > 0
+	}
+
+	for _, v := range q.graph[uid][args[0]] {
+		for _, arg := range args[1:] {
+			c, ok := fakeCompare(v, arg)
+			if !ok {
+				continue
+			}
+			switch {
+			case fn.name == "eq" && c == 0,
+				fn.name == "lt" && c < 0,
+				fn.name == "le" && c <= 0,
+				fn.name == "gt" && c > 0,
+				fn.name == "ge" && c >= 0:
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// fakeCompare compares a stored value with a query argument parsed to its type.
+func fakeCompare(v interface{}, arg string) (int, bool) {
+	var a, b float64
+	switch v := v.(type) {
+	case string:
+		return strings.Compare(v, arg), true
+	case time.Time:
+		t, err := time.Parse(time.RFC3339Nano, arg)
+		if err != nil {
+			return 0, false
+		}
+		a, b = float64(v.UnixNano()), float64(t.UnixNano())
+	case int64:
+		n, err := strconv.ParseFloat(arg, 64)
+		if err != nil {
+			return 0, false
+		}
+		a, b = float64(v), n
+	case float64:
+		n, err := strconv.ParseFloat(arg, 64)
+		if err != nil {
+			return 0, false
+		}
+		a, b = v, n
+	case bool:
+		x, err := strconv.ParseBool(arg)
+		if err != nil {
+			return 0, false
+		}
+		if x == v {
+			return 0, true
+		}
+		return 1, true
+	case fakeUid:
+		n, err := strconv.ParseUint(arg, 0, 64)
+		if err != nil {
+			return 0, false
+		}
+		a, b = float64(v), float64(n)
+	default:
+		return 0, false
+	}
+
+	switch {
+	case a < b:
+		return -1, true
+	case a > b:
+		return 1, true
+	}
+	return 0, true
+}
+
+// fakeCondition evaluates the @if condition of an upsert mutation on the
+// lengths of uid variables, e.g. @if(eq(len(v), 0)).
+func fakeCondition(cond string, vars map[string][]uint64) (bool, error) {
+	p, err := newFakeParser(cond, nil)
+	if err != nil {
+		return false, err
+	}
+	if err := p.expect("@"); err != nil {
+		return false, err
+	}
+	if err := p.expect("if"); err != nil {
+		return false, err
+	}
+	f, err := p.filter()
+	if err != nil {
+		return false, err
+	}
+	return evalFakeCondition(f, vars)
+}
+
+func evalFakeCondition(f *fakeFilter, vars map[string][]uint64) (bool, error) {
+	switch f.op {
+	case "and", "or":
+		for _, sub := range f.sub {
+			ok, err := evalFakeCondition(sub, vars)
+			if err != nil || ok == (f.op == "or") {
+				return ok, err
+			}
+		}
+		return f.op == "and", nil
+	case "not":
+		ok, err := evalFakeCondition(f.sub[0], vars)
+		return !ok, err
+	}
+
+	length, ok := f.fn.args[0].(*fakeFunc)
+	if !ok || length.name != "len" || len(f.fn.args) != 2 {
+		return false, fmt.Errorf("unsupported condition %s", f.fn.name)
+	}
+	n, err := strconv.Atoi(f.fn.args[1].(string))
+	if err != nil {
+		return false, err
+	}
+	l := len(vars[length.args[0].(string)])
+	switch f.fn.name {
+	case "eq":
+		return l == n, nil
+	case "lt":
+		return l < n, nil
+	case "le":
+		return l <= n, nil
+	case "gt":
+		return l > n, nil
+	case "ge":
+		return l >= n, nil
+	}
+	return false, fmt.Errorf("unsupported condition %s", f.fn.name)
+}
+
+// fakeParser parses DQL, with query variables substituted while tokenizing.
+type fakeParser struct {
+	tokens []string
+	pos    int
+}
+
+func newFakeParser(s string, vars map[string]string) (*fakeParser, error) {
+	p := &fakeParser{}
+	for i := 0; i < len(s); {
+		c := rune(s[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '"':
+			j := strings.IndexByte(s[i+1:], '"')
+			if j < 0 {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			p.tokens = append(p.tokens, s[i+1:i+1+j])
+			i += j + 2
+		case c == '$' || c == '_' || c == '.' || unicode.IsLetter(c) || unicode.IsDigit(c):
+			j := i + 1
+			for j < len(s) && (s[j] == '_' || s[j] == '.' || unicode.IsLetter(rune(s[j])) || unicode.IsDigit(rune(s[j]))) {
+				j++
+			}
+			token := s[i:j]
+			if c == '$' {
+				v, ok := vars[token]
+				if !ok {
+					// A parameter declaration, or a variable without value.
+					v = token
+				}
+				token = v
+			}
+			p.tokens = append(p.tokens, token)
+			i = j
+		default:
+			p.tokens = append(p.tokens, string(c))
+			i++
+		}
+	}
+	return p, nil
+}
+
+func (p *fakeParser) peek(n int) string {
+	if p.pos+n < len(p.tokens) {
+		return p.tokens[p.pos+n]
+	}
+	return ""
+}
+
+func (p *fakeParser) next() string {
+	t := p.peek(0)
+	p.pos++
+	return t
+}
+
+func (p *fakeParser) expect(token string) error {
+	if t := p.next(); t != token {
+		return fmt.Errorf("expected %q, got %q", token, t)
+	}
+	return nil
+}
+
+// parseFakeQuery parses the blocks of a query.
+func parseFakeQuery(query string, vars map[string]string) ([]*fakeBlock, error) {
+	p, err := newFakeParser(query, vars)
+	if err != nil {
+		return nil, err
+	}
+
+	// Skip the query name and parameters.
+	for p.peek(0) != "{" {
+		if p.next() == "" {
+			return nil, fmt.Errorf("no query block")
+		}
+	}
+	p.next()
+
+	var blocks []*fakeBlock
+	for p.peek(0) != "}" {
+		b, err := p.block(true)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, b)
+	}
+	return blocks, nil
+}
+
+// block parses a query block if root is set, a field otherwise.
+func (p *fakeParser) block(root bool) (*fakeBlock, error) {
+	b := &fakeBlock{}
+	if p.peek(1) == "as" {
+		b.as = p.next()
+		p.next()
+	}
+	if p.peek(0) == "~" {
+		p.next()
+		b.name = "~"
+	}
+	b.name += p.next()
+	if b.name == "" || b.name == "}" {
+		return nil, fmt.Errorf("unexpected end of query")
+	}
+
+	if root {
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		for p.peek(0) != ")" {
+			arg := p.next()
+			if err := p.expect(":"); err != nil {
+				return nil, err
+			}
+			var err error
+			switch arg {
+			case "func":
+				b.fn, err = p.function()
+			case "first":
+				b.first, err = strconv.Atoi(p.next())
+			case "after":
+				b.after, err = strconv.ParseUint(p.next(), 0, 64)
+			default:
+				err = fmt.Errorf("unsupported argument %s", arg)
+			}
+			if err != nil {
+				return nil, err
+			}
+			if p.peek(0) == "," {
+				p.next()
+			}
+		}
+		p.next()
+		if b.fn == nil {
+			return nil, fmt.Errorf("block %s without function", b.name)
+		}
+	}
+
+	for p.peek(0) == "@" {
+		p.next()
+		if err := p.expect("filter"); err != nil {
+			return nil, err
+		}
+		var err error
+		if b.filter, err = p.filter(); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.peek(0) == "{" {
+		p.next()
+		b.body = true
+		for p.peek(0) != "}" {
+			field, err := p.block(false)
+			if err != nil {
+				return nil, err
+			}
+			b.fields = append(b.fields, field)
+		}
+		p.next()
+	}
+	return b, nil
+}
+
+// function parses a function call.
+func (p *fakeParser) function() (*fakeFunc, error) {
+	fn := &fakeFunc{name: p.next()}
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	for p.peek(0) != ")" {
+		if p.peek(1) == "(" {
+			arg, err := p.function()
+			if err != nil {
+				return nil, err
+			}
+			fn.args = append(fn.args, arg)
+		} else {
+			fn.args = append(fn.args, p.next())
+		}
+		if p.peek(0) == "," {
+			p.next()
+		} else if p.peek(0) != ")" {
+			return nil, fmt.Errorf("unexpected %q in %s()", p.peek(0), fn.name)
+		}
+	}
+	p.next()
+	return fn, nil
+}
+
+// filter parses a parenthesized filter expression.
+func (p *fakeParser) filter() (*fakeFilter, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+
+	var terms []*fakeFilter
+	op := ""
+	for {
+		var term *fakeFilter
+		switch t := p.peek(0); {
+		case t == "(":
+			var err error
+			if term, err = p.filter(); err != nil {
+				return nil, err
+			}
+		case strings.EqualFold(t, "NOT"):
+			p.next()
+			fn, err := p.function()
+			if err != nil {
+				return nil, err
+			}
+			term = &fakeFilter{op: "not", sub: []*fakeFilter{{fn: fn}}}
+		default:
+			fn, err := p.function()
+			if err != nil {
+				return nil, err
+			}
+			term = &fakeFilter{fn: fn}
+		}
+		terms = append(terms, term)
+
+		t := p.next()
+		if t == ")" {
+			break
+		}
+		if !strings.EqualFold(t, "AND") && !strings.EqualFold(t, "OR") {
+			return nil, fmt.Errorf("unexpected %q in filter", t)
+		}
+		if op != "" && op != strings.ToLower(t) {
+			return nil, fmt.Errorf("mixed AND and OR in filter")
+		}
+		op = strings.ToLower(t)
+	}
+
+	if len(terms) == 1 {
+		return terms[0], nil
+	}
+	return &fakeFilter{op: op, sub: terms}, nil
+}
@@ -0,0 +1,102 @@
+package vagorillasessionsstores
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/dgraph-io/dgo/v200"
+	"github.com/dgraph-io/dgo/v200/protos/api"
+)
+
+// SessionLock represents the lease of a session lock in Dgraph, see DgraphBackend.TryLock()
+type SessionLock struct {
+	Uid         string    `json:"uid,omitempty"`
+	DType       []string  `json:"dgraph.type,omitempty"`
+	LockSession string    `json:"locksession,omitempty"`
+	LockToken   string    `json:"locktoken,omitempty"`
+	LockExpires time.Time `json:"lockexpires"`
+}
+
+// TryLock implements Locker with a SessionLock node per locked session. The
+// lease is read and taken over in one transaction, a concurrent attempt
+// aborts it. The first lease of a session relies on the @upsert directive of
+// locksession in the schema: without it, concurrent attempts creating a
+// node each would all succeed.
+func (b *DgraphBackend) TryLock(ctx context.Context, id, token string, ttl time.Duration) (bool, error) {
+	txn := b.db.NewTxn()
+	defer txn.Discard(ctx)
+
+	query := `query q($id: string) {
+	q(func: eq(locksession, $id)) {
+	  uid
+	  locktoken
+	  lockexpires
+	}
+}`
+
+	response, err := txn.QueryWithVars(ctx, query, map[string]string{"$id": id})
+	if err != nil {
+		return false, err
+	}
+
+	var r struct {
+		Q []SessionLock `json:"q"`
+	}
+
+	err = json.Unmarshal(response.Json, &r)
+	if err != nil {
+		return false, err
+	}
+
+	now := time.Now()
+	if len(r.Q) > 0 && r.Q[0].LockToken != token && r.Q[0].LockExpires.After(now) {
+		return false, nil
+	}
+
+	lease := SessionLock{
+		Uid:         "_:lock",
+		DType:       []string{"SessionLock"},
+		LockSession: id,
+		LockToken:   token,
+		LockExpires: now.Add(ttl),
+	}
+	if len(r.Q) > 0 {
+		lease.Uid = r.Q[0].Uid
+	}
+
+	mutation, err := json.Marshal(lease)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = txn.Mutate(ctx, &api.Mutation{SetJson: mutation, CommitNow: true})
+	if err == dgo.ErrAborted {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Unlock implements Locker, deleting the SessionLock node if token holds it.
+func (b *DgraphBackend) Unlock(ctx context.Context, id, token string) error {
+	query := `query q($id: string, $token: string) {
+		  q(func: eq(locksession, $id)) @filter(eq(locktoken, $token)) {
+			l as uid
+		  }
+}`
+
+	req := &api.Request{
+		Query: query,
+		Vars:  map[string]string{"$id": id, "$token": token},
+		Mutations: []*api.Mutation{
+			{
+				DeleteJson: []byte(`{"uid": "uid(l)"}`),
+			},
+		},
+		CommitNow: true,
+	}
+
+	_, err := b.db.NewTxn().Do(ctx, req)
+
+	return err
+}
@@ -0,0 +1,238 @@
+package vagorillasessionsstores
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// DgraphNode is a session value linking a session to an existing node of the
+// application's graph, e.g. a user, cart or device, by its uid. With
+// DgraphBackend.NativeValues it is stored as a valuenode edge, see
+// DgraphStore.SessionsForNode().
+type DgraphNode struct {
+	Uid string `json:"uid"`
+}
+
+// SessionValue represents a session value stored as a child node of its
+// Session with DgraphBackend.NativeValues. The value is held by the
+// predicate matching its type.
+type SessionValue struct {
+	Uid         string      `json:"uid,omitempty"`
+	DType       []string    `json:"dgraph.type,omitempty"`
+	ValueKey    string      `json:"valuekey,omitempty"`
+	ValueType   string      `json:"valuetype,omitempty"`
+	ValueString *string     `json:"valuestring,omitempty"`
+	ValueInt    *int64      `json:"valueint,omitempty"`
+	ValueFloat  *float64    `json:"valuefloat,omitempty"`
+	ValueBool   *bool       `json:"valuebool,omitempty"`
+	ValueTime   *time.Time  `json:"valuetime,omitempty"`
+	ValueJSON   *string     `json:"valuejson,omitempty"`
+	ValueNode   *DgraphNode `json:"valuenode,omitempty"`
+}
+
+// dgraphNumberTypes are the Go number types stored in valueint and
+// valuefloat, restored from the name kept in valuetype.
+var dgraphNumberTypes = map[string]reflect.Type{
+	"int":     reflect.TypeOf(int(0)),
+	"int8":    reflect.TypeOf(int8(0)),
+	"int16":   reflect.TypeOf(int16(0)),
+	"int32":   reflect.TypeOf(int32(0)),
+	"int64":   reflect.TypeOf(int64(0)),
+	"uint":    reflect.TypeOf(uint(0)),
+	"uint8":   reflect.TypeOf(uint8(0)),
+	"uint16":  reflect.TypeOf(uint16(0)),
+	"uint32":  reflect.TypeOf(uint32(0)),
+	"float32": reflect.TypeOf(float32(0)),
+	"float64": reflect.TypeOf(float64(0)),
+}
+
+// dgraphValueNodes returns the SessionValue nodes storing values.
+func dgraphValueNodes(values map[interface{}]interface{}) ([]map[string]interface{}, error) {
+	nodes := make([]map[string]interface{}, 0, len(values))
+	for k, v := range values {
+		key, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("session value key %v is a %T, not a string", k, k)
+		}
+
+		node, err := dgraphValueNode(key, v)
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
+// dgraphValueNode returns the SessionValue node storing v under key.
+func dgraphValueNode(key string, v interface{}) (map[string]interface{}, error) {
+	node := map[string]interface{}{
+		"dgraph.type": []string{"SessionValue"},
+		"valuekey":    key,
+	}
+
+	switch v := v.(type) {
+	case string:
+		node["valuestring"] = v
+	case bool:
+		node["valuebool"] = v
+	case time.Time:
+		node["valuetime"] = dgraphTime(v)
+	case DgraphNode:
+		node["valuenode"] = v
+	case nil:
+		node["valuejson"] = "null"
+	default:
+		name := reflect.TypeOf(v).String()
+		if t, ok := dgraphNumberTypes[name]; ok && t == reflect.TypeOf(v) {
+			node["valuetype"] = name
+			rv := reflect.ValueOf(v)
+			switch t.Kind() {
+			case reflect.Float32, reflect.Float64:
+				node["valuefloat"] = rv.Float()
+			case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+				node["valueint"] = int64(rv.Uint())
+			default:
+				node["valueint"] = rv.Int()
+			}
+			break
+		}
+
+		// Anything else is kept as JSON, readable but not typed.
+		data, err := json.Marshal(v)
+		if err != nil {
+			return nil, fmt.Errorf("session value %q: %w", key, err)
+		}
+		node["valuejson"] = string(data)
+	}
+
+	return node, nil
+}
+
+// dgraphDecodeValues returns the session values stored as SessionValue nodes.
+func dgraphDecodeValues(nodes []SessionValue) (map[interface{}]interface{}, error) {
+	values := make(map[interface{}]interface{}, len(nodes))
+	for _, n := range nodes {
+		switch {
+		case n.ValueString != nil:
+			values[n.ValueKey] = *n.ValueString
+		case n.ValueBool != nil:
+			values[n.ValueKey] = *n.ValueBool
+		case n.ValueTime != nil:
+			values[n.ValueKey] = *n.ValueTime
+		case n.ValueNode != nil:
+			values[n.ValueKey] = *n.ValueNode
+		case n.ValueInt != nil:
+			values[n.ValueKey] = dgraphNumber(reflect.ValueOf(*n.ValueInt), n.ValueType)
+		case n.ValueFloat != nil:
+			values[n.ValueKey] = dgraphNumber(reflect.ValueOf(*n.ValueFloat), n.ValueType)
+		case n.ValueJSON != nil:
+			var v interface{}
+			if err := json.Unmarshal([]byte(*n.ValueJSON), &v); err != nil {
+				return nil, fmt.Errorf("session value %q: %w", n.ValueKey, err)
+			}
+			values[n.ValueKey] = v
+		}
+	}
+	return values, nil
+}
+
+// dgraphNumber converts a stored number back to the Go type named by valuetype.
+func dgraphNumber(v reflect.Value, valuetype string) interface{} {
+	if t, ok := dgraphNumberTypes[valuetype]; ok {
+		return v.Convert(t).Interface()
+	}
+	return v.Interface()
+}
+
+// dgraphValueFields lists the predicates of the SessionValue nodes of a session fetched by queries.
+const dgraphValueFields = `
+	  sessionvalues {
+		valuekey
+		valuetype
+		valuestring
+		valueint
+		valuefloat
+		valuebool
+		valuetime
+		valuejson
+		valuenode {
+		  uid
+		}
+	  }`
+
+// StoresValues implements ValueStorer, it returns NativeValues.
+func (b *DgraphBackend) StoresValues() bool {
+	return b.NativeValues
+}
+
+// SessionsForNode returns the live sessions holding a DgraphNode value
+// linking them to the node with the given uid, by following the reverse
+// valuenode and sessionvalues edges.
+func (b *DgraphBackend) SessionsForNode(ctx context.Context, uid string) ([]SessionInfo, error) {
+	query := `query q($node: string, $now: string) {
+	q(func: uid($node)) {
+	  ~valuenode {
+		~sessionvalues @filter(gt(expiresat, $now)) {` + dgraphSessionFields + `
+		}
+	  }
+	}
+}`
+
+	vars := map[string]string{
+		"$node": uid,
+		"$now":  dgraphTime(time.Now()),
+	}
+
+	response, err := b.db.NewReadOnlyTxn().QueryWithVars(ctx, query, vars)
+	if err != nil {
+		return nil, err
+	}
+
+	var r struct {
+		Q []struct {
+			Values []struct {
+				Sessions []Session `json:"~sessionvalues"`
+			} `json:"~valuenode"`
+		} `json:"q"`
+	}
+
+	err = json.Unmarshal(response.Json, &r)
+	if err != nil {
+		return nil, err
+	}
+
+	// A session linking to the node under several keys is listed once.
+	seen := make(map[string]bool)
+	var infos []SessionInfo
+	for _, q := range r.Q {
+		for _, v := range q.Values {
+			for _, s := range v.Sessions {
+				if !seen[s.SessionID] {
+					seen[s.SessionID] = true
+					infos = append(infos, s.record().info())
+				}
+			}
+		}
+	}
+
+	return infos, nil
+}
+
+// SetNativeValues sets DgraphBackend.NativeValues, see there.
+// Sessions saved before keep their format until saved again.
+func (s *DgraphStore) SetNativeValues(native bool) {
+	s.backend.NativeValues = native
+}
+
+// SessionsForNode returns the live sessions linked to the node with the
+// given uid by a DgraphNode value, see DgraphBackend.SessionsForNode().
+func (s *DgraphStore) SessionsForNode(ctx context.Context, uid string) ([]SessionInfo, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	infos, err := s.backend.SessionsForNode(ctx, uid)
+	return infos, backendError(s.backend, "find", err)
+}
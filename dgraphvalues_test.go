@@ -0,0 +1,54 @@
+package vagorillasessionsstores
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// Test that session values survive the SessionValue node encoding with their Go types
+func TestDgraphValues(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	values := map[interface{}]interface{}{
+		"name":  "alice",
+		"admin": true,
+		"count": 3,
+		"ratio": float32(0.5),
+		"seen":  now,
+		"cart":  DgraphNode{Uid: "0x2a"},
+		"tags":  []string{"a", "b"},
+	}
+
+	nodes, err := dgraphValueNodes(values)
+	if err != nil {
+		t.Fatal("failed to encode values", err)
+	}
+	data, err := json.Marshal(nodes)
+	if err != nil {
+		t.Fatal("failed to marshal values", err)
+	}
+	var stored []SessionValue
+	if err := json.Unmarshal(data, &stored); err != nil {
+		t.Fatal("failed to unmarshal values", err)
+	}
+
+	decoded, err := dgraphDecodeValues(stored)
+	if err != nil {
+		t.Fatal("failed to decode values", err)
+	}
+	for _, key := range []string{"name", "admin", "count", "ratio", "cart"} {
+		if decoded[key] != values[key] {
+			t.Fatalf("bad value %q: %#v", key, decoded[key])
+		}
+	}
+	if seen, ok := decoded["seen"].(time.Time); !ok || !seen.Equal(now) {
+		t.Fatalf("bad time value %#v", decoded["seen"])
+	}
+	if tags, ok := decoded["tags"].([]interface{}); !ok || len(tags) != 2 {
+		t.Fatalf("bad JSON value %#v", decoded["tags"])
+	}
+
+	if _, err := dgraphValueNodes(map[interface{}]interface{}{42: "bar"}); err == nil {
+		t.Fatal("non-string keys should be rejected")
+	}
+}
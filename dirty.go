@@ -0,0 +1,91 @@
+package vagorillasessionsstores
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/gorilla/sessions"
+)
+
+// digestKey holds the digest of the values of a session as loaded, see Store.SkipUnchanged.
+const digestKey metaKey = "digest"
+
+// valuesDigest returns a digest of the values and user of session. It
+// reports false for values it cannot digest, which are always written.
+//
+// Values are digested one by one in key order, so the digest does not
+// depend on map iteration order. Maps nested in values may still digest
+// differently every time, which only costs a write.
+func valuesDigest(session *sessions.Session) (string, bool) {
+	values := storedValues(session.Values)
+
+	keys := make([]string, 0, len(values))
+	byKey := make(map[string]interface{}, len(values))
+	for k, v := range values {
+		key := fmt.Sprintf("%T:%v", k, k)
+		keys = append(keys, key)
+		byKey[key] = v
+	}
+	sort.Strings(keys)
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%q\n", UserID(session))
+	enc := gob.NewEncoder(h)
+	for _, key := range keys {
+		fmt.Fprintf(h, "%q\n", key)
+		if v := byKey[key]; v == nil {
+			fmt.Fprint(h, "nil\n")
+		} else if err := enc.Encode(v); err != nil {
+			return "", false
+		}
+	}
+
+	return string(h.Sum(nil)), true
+}
+
+// markClean records the digest of the current values of session.
+func (s *Store) markClean(session *sessions.Session) {
+	if !s.SkipUnchanged {
+		return
+	}
+
+	if digest, ok := valuesDigest(session); ok {
+		session.Values[digestKey] = digest
+	} else {
+		delete(session.Values, digestKey)
+	}
+}
+
+// unchanged reports whether the values of session are the ones it was loaded or last saved with.
+func (s *Store) unchanged(session *sessions.Session) bool {
+	loaded, ok := session.Values[digestKey].(string)
+	if !ok {
+		return false
+	}
+
+	digest, ok := valuesDigest(session)
+	return ok && digest == loaded
+}
+
+// skipSave handles the save of an unchanged session when the store is set to
+// skip them, touching it if TouchUnchanged is set. It reports false when the
+// session must be written.
+func (s *Store) skipSave(ctx context.Context, session *sessions.Session) (bool, error) {
+	if !s.SkipUnchanged || !s.unchanged(session) {
+		return false, nil
+	}
+	if !s.TouchUnchanged {
+		return true, nil
+	}
+
+	err := s.Touch(ctx, session)
+	if errors.Is(err, ErrSessionNotFound) {
+		// Gone from the database in the meantime, write it again.
+		return false, nil
+	}
+	return true, err
+}
@@ -0,0 +1,67 @@
+package vagorillasessionsstores
+
+import (
+	"encoding/json"
+	"time"
+	"unicode/utf8"
+)
+
+// jsonEntry is the value stored under a session key by the key-value
+// back-ends, BadgerBackend and RedisBackend.
+type jsonEntry struct {
+	Name   string `json:"name,omitempty"`
+	UserID string `json:"userid,omitempty"`
+	// Text holds values that are valid UTF-8, such as JSON encoded values,
+	// so they can be read as is. Value holds the others, base64 encoded.
+	Text    string    `json:"text,omitempty"`
+	Value   []byte    `json:"value,omitempty"`
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+	// ExpiresAt is only read by back-ends without a per-key expiry time to
+	// read it from.
+	ExpiresAt time.Time `json:"expiresAt"`
+	Version   int64     `json:"version,omitempty"`
+}
+
+// newJSONEntry returns the entry storing rec.
+func newJSONEntry(rec *Record) jsonEntry {
+	entry := jsonEntry{
+		Name:      rec.Name,
+		UserID:    rec.UserID,
+		Created:   rec.Created,
+		Updated:   rec.Updated,
+		ExpiresAt: rec.ExpiresAt,
+		Version:   rec.Version,
+	}
+	if utf8.Valid(rec.Value) {
+		entry.Text = string(rec.Value)
+	} else {
+		entry.Value = rec.Value
+	}
+	return entry
+}
+
+// decodeJSONEntry decodes a stored entry.
+func decodeJSONEntry(val []byte) (jsonEntry, error) {
+	var entry jsonEntry
+	err := json.Unmarshal(val, &entry)
+	return entry, err
+}
+
+// record converts the entry stored under session id to a Record.
+func (e *jsonEntry) record(id string) *Record {
+	rec := &Record{
+		ID:        id,
+		Name:      e.Name,
+		UserID:    e.UserID,
+		Value:     e.Value,
+		Created:   e.Created,
+		Updated:   e.Updated,
+		ExpiresAt: e.ExpiresAt,
+		Version:   e.Version,
+	}
+	if e.Text != "" {
+		rec.Value = []byte(e.Text)
+	}
+	return rec
+}
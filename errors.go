@@ -0,0 +1,76 @@
+package vagorillasessionsstores
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrSessionNotFound is returned by a Backend when no record exists for a session ID.
+	// Store.New() and Store.Get() turn it into a new session without an error.
+	ErrSessionNotFound = errors.New("session not found")
+
+	// ErrSessionExpired is returned when a session record exists but is past its expiry.
+	// It comes with a new session.
+	ErrSessionExpired = errors.New("session expired")
+
+	// ErrInvalidCookie is returned when the session cookie could not be decoded,
+	// because it was forged, tampered with or signed with a key no longer in use.
+	// It comes with a new session.
+	ErrInvalidCookie = errors.New("invalid session cookie")
+
+	// ErrNotSupported is returned when the Backend of a store does not implement
+	// an optional operation, such as listing sessions.
+	ErrNotSupported = errors.New("operation not supported by the session back-end")
+
+	// ErrConcurrentModification is returned when saving a session that was
+	// saved by another request since it was loaded. See Store.Merge.
+	ErrConcurrentModification = errors.New("session modified concurrently")
+
+	// ErrLockLost is returned when extending a session lock whose lease ran
+	// out and was taken by another holder.
+	ErrLockLost = errors.New("session lock lost")
+)
+
+// BackendError wraps an error returned by the database driver of a Backend,
+// such as a lost connection or a timeout.
+type BackendError struct {
+	// Backend is the name of the back-end, e.g. "badger".
+	Backend string
+	// Op is the failed operation, e.g. "load", "save" or "delete".
+	Op  string
+	Err error
+}
+
+func (e *BackendError) Error() string {
+	return fmt.Sprintf("%s session %s: %v", e.Backend, e.Op, e.Err)
+}
+
+// Unwrap returns the driver error.
+func (e *BackendError) Unwrap() error {
+	return e.Err
+}
+
+// backendName returns the name used for b in errors.
+// Backends may provide it with a Name() string method.
+func backendName(b Backend) string {
+	if n, ok := b.(interface{ Name() string }); ok {
+		return n.Name()
+	}
+	return fmt.Sprintf("%T", b)
+}
+
+// backendError wraps err in a BackendError unless it is one of the package's sentinel errors.
+func backendError(b Backend, op string, err error) error {
+	if err == nil || errors.Is(err, ErrSessionNotFound) || errors.Is(err, ErrSessionExpired) ||
+		errors.Is(err, ErrNotSupported) || errors.Is(err, ErrConcurrentModification) {
+		return err
+	}
+
+	var be *BackendError
+	if errors.As(err, &be) {
+		return err
+	}
+
+	return &BackendError{Backend: backendName(b), Op: op, Err: err}
+}
@@ -0,0 +1,123 @@
+package vagorillasessionsstores
+
+import (
+	"context"
+	"time"
+)
+
+// defaultListLimit is the page size used when ListOptions.Limit is not set.
+const defaultListLimit = 100
+
+// Lister is implemented by back-ends able to enumerate the sessions they store.
+type Lister interface {
+	// List returns one page of live sessions matching opts, ordered by ID for
+	// Badger, Mongo and SQL and by node for Dgraph, and the cursor of the next page.
+	// The cursor is empty on the last page.
+	List(ctx context.Context, opts ListOptions) ([]SessionInfo, string, error)
+}
+
+// ListOptions filters and paginates Store.List().
+// Zero values do not filter.
+type ListOptions struct {
+	// Name only lists sessions saved under this session name.
+	Name string
+
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	UpdatedAfter  time.Time
+	UpdatedBefore time.Time
+
+	// Cursor continues a listing where the previous page ended.
+	Cursor string
+	// Limit is the maximum number of sessions per page, 100 if not set.
+	Limit int
+}
+
+// limit returns the page size to use.
+func (o ListOptions) limit() int {
+	if o.Limit <= 0 {
+		return defaultListLimit
+	}
+	return o.Limit
+}
+
+// match reports whether info passes the filters of o,
+// for back-ends that cannot filter in the database.
+func (o ListOptions) match(info SessionInfo) bool {
+	switch {
+	case o.Name != "" && info.Name != o.Name:
+		return false
+	case !o.CreatedAfter.IsZero() && !info.Created.After(o.CreatedAfter):
+		return false
+	case !o.CreatedBefore.IsZero() && !info.Created.Before(o.CreatedBefore):
+		return false
+	case !o.UpdatedAfter.IsZero() && !info.Updated.After(o.UpdatedAfter):
+		return false
+	case !o.UpdatedBefore.IsZero() && !info.Updated.Before(o.UpdatedBefore):
+		return false
+	case !info.ExpiresAt.IsZero() && info.ExpiresAt.Before(time.Now()):
+		return false
+	}
+	return true
+}
+
+// SessionInfo describes a stored session without decoding its values.
+type SessionInfo struct {
+	ID        string
+	Name      string
+	UserID    string
+	Created   time.Time
+	Updated   time.Time
+	ExpiresAt time.Time
+}
+
+// info returns the description of rec.
+func (r *Record) info() SessionInfo {
+	return SessionInfo{
+		ID:        r.ID,
+		Name:      r.Name,
+		UserID:    r.UserID,
+		Created:   r.Created,
+		Updated:   r.Updated,
+		ExpiresAt: r.ExpiresAt,
+	}
+}
+
+// List returns one page of the stored sessions matching opts and the cursor
+// of the next page, empty on the last one. Pass the cursor back in
+// opts.Cursor to continue.
+//
+// It returns ErrNotSupported if the back-end cannot enumerate sessions.
+func (s *Store) List(ctx context.Context, opts ListOptions) ([]SessionInfo, string, error) {
+	lister, ok := s.backend.(Lister)
+	if !ok {
+		return nil, "", ErrNotSupported
+	}
+
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	infos, next, err := lister.List(ctx, opts)
+	return infos, next, backendError(s.backend, "list", err)
+}
+
+// Iterate calls fn for every stored session matching opts, fetching them page
+// by page. It stops at the first error returned by fn and returns it.
+func (s *Store) Iterate(ctx context.Context, opts ListOptions, fn func(SessionInfo) error) error {
+	for {
+		infos, next, err := s.List(ctx, opts)
+		if err != nil {
+			return err
+		}
+
+		for _, info := range infos {
+			if err := fn(info); err != nil {
+				return err
+			}
+		}
+
+		if next == "" {
+			return nil
+		}
+		opts.Cursor = next
+	}
+}
@@ -0,0 +1,140 @@
+package vagorillasessionsstores
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/securecookie"
+)
+
+// lockPollInterval is how often Store.Lock() retries to acquire a lock held elsewhere.
+const lockPollInterval = 50 * time.Millisecond
+
+// Locker is implemented by back-ends able to lock sessions across processes.
+// Locks are leases: they are released after their TTL even if their holder
+// never unlocks them, e.g. because it crashed.
+type Locker interface {
+	// TryLock acquires the lock of session id for ttl under token, or extends
+	// it if token already holds it. It reports false if another token holds it.
+	TryLock(ctx context.Context, id, token string, ttl time.Duration) (bool, error)
+	// Unlock releases the lock of session id if token holds it.
+	Unlock(ctx context.Context, id, token string) error
+}
+
+// Lock is a held session lock, see Store.Lock().
+type Lock struct {
+	store *Store
+	id    string
+	token string
+}
+
+// Lock acquires the lock of the session stored under id for ttl, waiting for
+// other holders to release it or for their lease to run out. It returns
+// ctx.Err() if ctx is done first.
+//
+// Locks are opt-in: loading and saving sessions ignores them, only callers
+// of Lock() are serialized. It returns ErrNotSupported if the back-end
+// cannot lock sessions.
+func (s *Store) Lock(ctx context.Context, id string, ttl time.Duration) (*Lock, error) {
+	locker, ok := s.backend.(Locker)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+
+	lock := &Lock{store: s, id: id, token: newSessionID()}
+	for {
+		acquired, err := s.tryLock(ctx, locker, lock, ttl)
+		if err != nil && ctx.Err() != nil {
+			// The back-end may wrap the context error, e.g. in a gRPC status.
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			return nil, err
+		}
+		if acquired {
+			return lock, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(lockPollInterval):
+		}
+	}
+}
+
+// tryLock makes a single attempt at acquiring lock.
+func (s *Store) tryLock(ctx context.Context, locker Locker, lock *Lock, ttl time.Duration) (acquired bool, err error) {
+	ctx, done := s.start(ctx, "lock", "")
+	defer func() { done(err) }()
+
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	acquired, err = locker.TryLock(ctx, lock.id, lock.token, ttl)
+	if err != nil {
+		return false, backendError(s.backend, "lock", err)
+	}
+	return acquired, nil
+}
+
+// Extend renews the lease of l for ttl from now, e.g. for long running work.
+// It returns an error if the lease ran out and another holder took the lock.
+func (l *Lock) Extend(ctx context.Context, ttl time.Duration) error {
+	acquired, err := l.store.tryLock(ctx, l.store.backend.(Locker), l, ttl)
+	if err == nil && !acquired {
+		err = ErrLockLost
+	}
+	return err
+}
+
+// Unlock releases l. Releasing a lock whose lease ran out is not an error.
+func (l *Lock) Unlock(ctx context.Context) (err error) {
+	s := l.store
+	ctx, done := s.start(ctx, "unlock", "")
+	defer func() { done(err) }()
+
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	return backendError(s.backend, "unlock", s.backend.(Locker).Unlock(ctx, l.id, l.token))
+}
+
+// LockMiddleware returns a middleware handling one request at a time per
+// session, across all instances sharing the back-end. The session is found
+// from the cookie called name; requests without a valid cookie are not
+// locked. The lock is held for at most ttl.
+//
+// A request whose context ends while waiting for the lock is answered with
+// 503 Service Unavailable, a back-end error with 500 Internal Server Error.
+func (s *Store) LockMiddleware(name string, ttl time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			c, err := r.Cookie(name)
+			if err != nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			var id string
+			if err := securecookie.DecodeMulti(name, c.Value, &id, s.Codecs...); err != nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			lock, err := s.Lock(r.Context(), id, ttl)
+			switch {
+			case errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded):
+				http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+				return
+			case err != nil:
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			// The request context may be done by now, unlock regardless.
+			defer lock.Unlock(context.Background())
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package vagorillasessionsstores
+
+import (
+	"errors"
+	"expvar"
+	"time"
+)
+
+// Outcome classifies how a store operation ended, see Observer.
+type Outcome string
+
+const (
+	// OutcomeOK is a successful operation.
+	OutcomeOK Outcome = "ok"
+	// OutcomeNotFound is a load of a session missing from the back-end.
+	OutcomeNotFound Outcome = "not_found"
+	// OutcomeExpired is a load of an expired session.
+	OutcomeExpired Outcome = "expired"
+	// OutcomeInvalid is a cookie or session values that failed to decode or encode.
+	OutcomeInvalid Outcome = "invalid"
+	// OutcomeConflict is a save rejected with ErrConcurrentModification.
+	OutcomeConflict Outcome = "conflict"
+	// OutcomeError is a failure of the back-end, see BackendError.
+	OutcomeError Outcome = "error"
+)
+
+// Observer is notified of the operations of a Store, e.g. to export
+// metrics. Operations are "new" when a new session is handed out, "load",
+// "save", "touch", "delete", "regenerate" for RegenerateID(), "lock" for
+// each attempt at a session lock and "unlock"; backend is the name used in
+// BackendError.
+//
+// Observe is called on the request path, it must be safe for concurrent
+// use and return quickly.
+type Observer interface {
+	Observe(op, backend string, duration time.Duration, outcome Outcome)
+}
+
+// outcomeOf returns the Outcome of an operation that returned err.
+func outcomeOf(err error) Outcome {
+	var be *BackendError
+	switch {
+	case err == nil:
+		return OutcomeOK
+	case errors.Is(err, ErrSessionNotFound):
+		return OutcomeNotFound
+	case errors.Is(err, ErrSessionExpired):
+		return OutcomeExpired
+	case errors.Is(err, ErrConcurrentModification):
+		return OutcomeConflict
+	case errors.As(err, &be):
+		return OutcomeError
+	default:
+		// Anything else comes from the cookie codecs or the value serializer.
+		return OutcomeInvalid
+	}
+}
+
+// observe reports an operation started at start that returned err to the store's Observer.
+func (s *Store) observe(op string, start time.Time, err error) {
+	if s.Observer == nil {
+		return
+	}
+	s.Observer.Observe(op, backendName(s.backend), time.Since(start), outcomeOf(err))
+}
+
+// NewExpvarObserver returns an Observer publishing its counts with expvar
+// under name, e.g. on /debug/vars. Like expvar.Publish() it panics if name
+// is already in use.
+//
+// The published map holds the count of operations keyed by
+// "backend.op.outcome" under "calls", and their total duration in seconds
+// keyed by "backend.op" under "seconds".
+func NewExpvarObserver(name string) *ExpvarObserver {
+	o := &ExpvarObserver{
+		calls:   new(expvar.Map).Init(),
+		seconds: new(expvar.Map).Init(),
+	}
+
+	m := expvar.NewMap(name)
+	m.Set("calls", o.calls)
+	m.Set("seconds", o.seconds)
+	return o
+}
+
+// ExpvarObserver is an Observer counting operations with expvar.
+type ExpvarObserver struct {
+	calls   *expvar.Map
+	seconds *expvar.Map
+}
+
+// Observe implements Observer.
+func (o *ExpvarObserver) Observe(op, backend string, duration time.Duration, outcome Outcome) {
+	o.calls.Add(backend+"."+op+"."+string(outcome), 1)
+	o.seconds.AddFloat(backend+"."+op, duration.Seconds())
+}
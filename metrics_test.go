@@ -0,0 +1,134 @@
+package vagorillasessionsstores
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+// recordingObserver records the operations it observes as "op outcome".
+type recordingObserver struct {
+	ops []string
+}
+
+func (o *recordingObserver) Observe(op, backend string, duration time.Duration, outcome Outcome) {
+	o.ops = append(o.ops, fmt.Sprintf("%s %s", op, outcome))
+}
+
+// Test that the store reports its operations and their outcomes
+func TestStoreObserver(t *testing.T) {
+	store := NewStore(newMemoryBackend(), []byte("some key"))
+	observer := &recordingObserver{}
+	store.Observer = observer
+	ctx := context.Background()
+
+	req, err := http.NewRequest("GET", "http://www.example.com", nil)
+	if err != nil {
+		t.Fatal("failed to create request", err)
+	}
+	session, err := store.New(req, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	session.Values["foo"] = "bar"
+	w := httptest.NewRecorder()
+	if err := store.Save(req, w, session); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	req.Header.Add("Cookie", w.Header().Get("Set-Cookie"))
+
+	if _, err := store.New(req, "hello"); err != nil {
+		t.Fatal("failed to load session", err)
+	}
+	if err := store.DeleteByID(ctx, session.ID); err != nil {
+		t.Fatal("failed to delete session", err)
+	}
+	if _, err := store.New(req, "hello"); err != nil {
+		t.Fatal("failed to load deleted session", err)
+	}
+	if _, err := store.GetContext(ctx, "hello", "forged"); err == nil {
+		t.Fatal("expected an error for a forged cookie")
+	}
+
+	expected := []string{
+		"new ok",
+		"save ok",
+		"load ok",
+		"delete ok",
+		"load not_found", "new ok",
+		"load invalid", "new ok",
+	}
+	if fmt.Sprint(observer.ops) != fmt.Sprint(expected) {
+		t.Fatalf("expected operations %v, got %v", expected, observer.ops)
+	}
+}
+
+// Test that ID regenerations and lock calls are reported too
+func TestStoreObserverRegenerateLock(t *testing.T) {
+	store, err := NewBadgerStore(t.TempDir(), []byte("some key"))
+	if err != nil {
+		t.Fatal("failed to create store", err)
+	}
+	defer store.Close()
+	observer := &recordingObserver{}
+	store.Observer = observer
+	ctx := context.Background()
+
+	req, err := http.NewRequest("GET", "http://www.example.com", nil)
+	if err != nil {
+		t.Fatal("failed to create request", err)
+	}
+	session := sessions.NewSession(store, "hello")
+	session.Options = &sessions.Options{MaxAge: 60}
+	if err := store.SaveByID(ctx, session); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	if err := store.RegenerateID(req, httptest.NewRecorder(), session); err != nil {
+		t.Fatal("failed to regenerate session ID", err)
+	}
+
+	lock, err := store.Lock(ctx, session.ID, time.Minute)
+	if err != nil {
+		t.Fatal("failed to lock session", err)
+	}
+	if err := lock.Unlock(ctx); err != nil {
+		t.Fatal("failed to unlock session", err)
+	}
+
+	expected := []string{"save ok", "regenerate ok", "lock ok", "unlock ok"}
+	if fmt.Sprint(observer.ops) != fmt.Sprint(expected) {
+		t.Fatalf("expected operations %v, got %v", expected, observer.ops)
+	}
+}
+
+// expvarRuns counts the runs of TestExpvarObserver.
+var expvarRuns int64
+
+// Test that the expvar observer counts operations by back-end, operation and outcome
+func TestExpvarObserver(t *testing.T) {
+	// expvar names are global, -count runs the test again in the same process.
+	name := fmt.Sprintf("sessions_test_%d", atomic.AddInt64(&expvarRuns, 1))
+	observer := NewExpvarObserver(name)
+	observer.Observe("load", "badger", time.Second, OutcomeOK)
+	observer.Observe("load", "badger", time.Second, OutcomeOK)
+	observer.Observe("load", "badger", time.Second, OutcomeExpired)
+
+	vars := expvar.Get(name).(*expvar.Map)
+	calls := vars.Get("calls").(*expvar.Map)
+	if v := calls.Get("badger.load.ok").String(); v != "2" {
+		t.Fatalf("expected 2 successful loads, got %s", v)
+	}
+	if v := calls.Get("badger.load.expired").String(); v != "1" {
+		t.Fatalf("expected 1 expired load, got %s", v)
+	}
+	if v := vars.Get("seconds").(*expvar.Map).Get("badger.load").String(); v != "3" {
+		t.Fatalf("expected 3 seconds of loads, got %s", v)
+	}
+}
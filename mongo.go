@@ -1,15 +1,11 @@
-// Package vagorillasessionsstores is a Gorilla sessions.Store implementation for BadgerDB, MongoDB and Dgraph
+// Package vagorillasessionsstores is a Gorilla sessions.Store implementation for BadgerDB, MongoDB, Dgraph, Redis and SQL databases
 package vagorillasessionsstores
 
 import (
 	"context"
-	"encoding/base32"
-	"net/http"
-	"strings"
 	"time"
+	"unicode/utf8"
 
-	"github.com/gorilla/securecookie"
-	"github.com/gorilla/sessions"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -21,6 +17,8 @@ import (
 // If databaseName is left empty "" a default "sessions" named database will be created.
 // If collectionName is left empty "" a default "store" named collection will be created.
 //
+// The collection's indexes are created on start, see EnsureIndexes().
+//
 // Keys are defined in pairs to allow key rotation, but the common case is
 // to set a single authentication key and optionally an encryption key.
 //
@@ -40,165 +38,363 @@ func NewMongoStore(client *mongo.Client, databaseName string, collectionName str
 		collectionName = "store"
 	}
 
-	collection := client.Database(databaseName).Collection(collectionName)
-
+	backend := NewMongoBackend(client.Database(databaseName).Collection(collectionName))
 	store := &MongoStore{
-		Codecs: securecookie.CodecsFromPairs(keyPairs...),
-		Options: &sessions.Options{
-			Path:   "/",
-			MaxAge: 86400 * 30,
-		},
-		db: collection,
+		Store:   NewStore(backend, keyPairs...),
+		backend: backend,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := store.EnsureIndexes(ctx); err != nil {
+		return nil, err
 	}
 
-	store.MaxAge(store.Options.MaxAge)
 	return store, nil
 }
 
 // MongoStore stores sessions using MongoDB
 type MongoStore struct {
-	Codecs  []securecookie.Codec
-	Options *sessions.Options
-	db      *mongo.Collection
+	*Store
+	backend *MongoBackend
 }
 
-// Get returns a session for the given name after adding it to the registry.
-//
-// It returns a new session if the sessions doesn't exist. Access IsNew on
-// the session to check if it is an existing session or a new one.
-//
-// It returns a new session and an error if the session exists but could
-// not be decoded.
-func (s *MongoStore) Get(r *http.Request, name string) (*sessions.Session, error) {
-	return sessions.GetRegistry(r).Get(s, name)
+// EnsureIndexes creates the indexes the store relies on, see MongoBackend.EnsureIndexes().
+func (s *MongoStore) EnsureIndexes(ctx context.Context) error {
+	return s.backend.EnsureIndexes(ctx)
 }
 
-// New returns a session for the given name without adding it to the registry.
-//
-// The difference between New() and Get() is that calling New() twice will
-// decode the session data twice, while Get() registers and reuses the same
-// decoded session after the first call.
-func (s *MongoStore) New(r *http.Request, name string) (*sessions.Session, error) {
-	session := sessions.NewSession(s, name)
-	opts := *s.Options
-	session.Options = &opts
-	session.IsNew = true
-	var err error
-	if c, errCookie := r.Cookie(name); errCookie == nil {
-		err = securecookie.DecodeMulti(name, c.Value, &session.ID,
-			s.Codecs...)
-		err = s.load(session)
-		if err == nil {
-			session.IsNew = false
-		}
+// NewMongoBackend returns a Backend persisting sessions in collection.
+// Call EnsureIndexes() once to have MongoDB expire sessions by itself.
+func NewMongoBackend(collection *mongo.Collection) *MongoBackend {
+	return &MongoBackend{
+		db:    collection,
+		locks: collection.Database().Collection(collection.Name() + "_locks"),
 	}
-	return session, err
 }
 
-// Save adds a single session to the response.
+// MongoBackend is a Backend storing one SessionEntry document per session.
+type MongoBackend struct {
+	// NativeValues stores session values as a BSON subdocument named values
+	// instead of an encoded string, so they can be queried and only changed
+	// keys are written. Keys must be strings, custom types should be
+	// registered with RegisterBSONType().
+	NativeValues bool
+	db           *mongo.Collection
+	// locks holds the lease documents of session locks, see TryLock().
+	locks *mongo.Collection
+}
+
+// EnsureIndexes creates the indexes the store relies on. A TTL index on expiresAt
+// lets MongoDB remove expired sessions by itself, a unique index on sessionid
+// keeps lookups from scanning the whole collection and an index on userid
+// serves the per-user queries. Expired session locks are removed with a TTL
+// index too.
 //
-// If the Options.MaxAge of the session is <= 0 then the session file will be
-// deleted from the store path. With this process it enforces the properly
-// session cookie handling so no need to trust in the cookie management in the
-// web browser.
-func (s *MongoStore) Save(r *http.Request, w http.ResponseWriter,
-	session *sessions.Session) error {
-	// Delete if max-age is <= 0
-	if session.Options.MaxAge <= 0 {
-		if err := s.erase(session); err != nil {
-			return err
-		}
-		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
-		return nil
+// NewMongoStore() calls it on start. Creating an index that already exists is a no-op.
+func (b *MongoBackend) EnsureIndexes(ctx context.Context) error {
+	_, err := b.db.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "expiresAt", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+		{
+			Keys:    bson.D{{Key: "sessionid", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bson.D{{Key: "userid", Value: 1}},
+		},
+	})
+	if err != nil {
+		return err
 	}
 
-	if session.ID == "" {
-		session.ID = strings.TrimRight(
-			base32.StdEncoding.EncodeToString(
-				securecookie.GenerateRandomKey(32)), "=")
-	}
+	_, err = b.locks.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expiresAt", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
 
-	if err := s.save(session); err != nil {
-		return err
+	return err
+}
+
+// SessionEntry represents a session document in MongoDB
+type SessionEntry struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty"`
+	SessionID string             `bson:"sessionid,omitempty"`
+	Name      string             `bson:"name,omitempty"`
+	UserID    string             `bson:"userid,omitempty"`
+	// Value holds session values that are valid UTF-8, Data the others.
+	Value string `bson:"value,omitempty"`
+	Data  []byte `bson:"data,omitempty"`
+	// Values holds the session values stored with MongoBackend.NativeValues.
+	Values    bson.Raw  `bson:"values,omitempty"`
+	Version   int64     `bson:"version,omitempty"`
+	Created   time.Time `bson:"created,omitempty"`
+	Updated   time.Time `bson:"updated,omitempty"`
+	ExpiresAt time.Time `bson:"expiresAt,omitempty"`
+}
+
+// record converts the document to a Record.
+func (e *SessionEntry) record() *Record {
+	return &Record{
+		ID:        e.SessionID,
+		Name:      e.Name,
+		UserID:    e.UserID,
+		Value:     e.value(),
+		Created:   e.Created,
+		Updated:   e.Updated,
+		ExpiresAt: e.ExpiresAt,
+		Version:   e.Version,
 	}
+}
 
-	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID,
-		s.Codecs...)
-	if err != nil {
-		return err
+// value returns the stored session values.
+func (e *SessionEntry) value() []byte {
+	if e.Data != nil {
+		return e.Data
 	}
+	return []byte(e.Value)
+}
 
-	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
-	return nil
+// Name returns "mongo".
+func (b *MongoBackend) Name() string {
+	return "mongo"
 }
 
-// MaxAge sets the maximum age for the store and the underlying cookie
-// implementation. Individual sessions can be deleted by setting Options.MaxAge
-// = -1 for that session.
-func (s *MongoStore) MaxAge(age int) {
-	s.Options.MaxAge = age
+// Load implements Backend.
+func (b *MongoBackend) Load(ctx context.Context, id string) (*Record, error) {
+	var result SessionEntry
 
-	// Set the maxAge for each securecookie instance.
-	for _, codec := range s.Codecs {
-		if sc, ok := codec.(*securecookie.SecureCookie); ok {
-			sc.MaxAge(age)
+	res := b.db.FindOne(ctx, bson.D{{Key: "sessionid", Value: id}})
+	err := res.Decode(&result)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rec := result.record()
+	if result.Values != nil {
+		if rec.Values, err = decodeBSONValues(result.Values); err != nil {
+			return nil, err
 		}
 	}
+	return rec, nil
 }
 
-type SessionEntry struct {
-	ID        primitive.ObjectID `bson:"_id,omitempty"`
-	SessionID string             `bson:"sessionid,omitempty"`
-	Value     string             `bson:"value,omitempty"`
+// Save implements Backend.
+func (b *MongoBackend) Save(ctx context.Context, rec *Record) error {
+	return b.upsert(ctx, rec.ID, rec)
 }
 
-func (s *MongoStore) save(session *sessions.Session) error {
-	encoded, err := securecookie.EncodeMulti(session.Name(), session.Values,
-		s.Codecs...)
-	if err != nil {
-		return err
+// Rename implements Renamer by changing the sessionid of the existing
+// document in a single update.
+func (b *MongoBackend) Rename(ctx context.Context, oldID string, rec *Record) error {
+	return b.upsert(ctx, oldID, rec)
+}
+
+// upsert writes rec to the document stored under matchID, creating it if
+// needed. With a non-zero rec.Version, only the document with that version
+// is replaced and none is created.
+func (b *MongoBackend) upsert(ctx context.Context, matchID string, rec *Record) error {
+	if rec.Values != nil {
+		return b.upsertValues(ctx, matchID, rec)
 	}
 
-	filt := SessionEntry{
-		SessionID: session.ID,
+	filt := mongoVersionFilter(matchID, rec.Version)
+
+	// Keep text readable in the database, store anything else as binary.
+	value := bson.E{Key: "value", Value: string(rec.Value)}
+	unset := bson.E{Key: "data", Value: ""}
+	if !utf8.Valid(rec.Value) {
+		value = bson.E{Key: "data", Value: rec.Value}
+		unset = bson.E{Key: "value", Value: ""}
 	}
 
-	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
-	opts := options.Update().SetUpsert(true)
-	_, err = s.db.UpdateOne(
+	opts := options.FindOneAndUpdate().
+		SetUpsert(rec.Version == 0).
+		SetReturnDocument(options.After).
+		SetProjection(bson.D{{Key: "version", Value: 1}})
+	var after SessionEntry
+	err := b.db.FindOneAndUpdate(
 		ctx,
 		filt,
 		bson.D{
-			{"$set", bson.D{{"value", encoded}, {"sessionid", session.ID}}},
+			{Key: "$set", Value: bson.D{
+				value,
+				{Key: "sessionid", Value: rec.ID},
+				{Key: "name", Value: rec.Name},
+				{Key: "userid", Value: rec.UserID},
+				{Key: "updated", Value: rec.Updated},
+				{Key: "expiresAt", Value: rec.ExpiresAt},
+			}},
+			{Key: "$unset", Value: bson.D{unset, {Key: "values", Value: ""}}},
+			{Key: "$setOnInsert", Value: bson.D{{Key: "created", Value: rec.Created}}},
+			{Key: "$inc", Value: bson.D{{Key: "version", Value: int64(1)}}},
 		},
 		opts,
+	).Decode(&after)
+	if err == mongo.ErrNoDocuments {
+		return ErrConcurrentModification
+	}
+	if err != nil {
+		return err
+	}
+
+	rec.Version = after.Version
+	return nil
+}
+
+// mongoVersionFilter returns the filter matching the document stored under
+// id, only at version unless it is zero. Fields are always given explicitly:
+// a SessionEntry would omit an empty id and match any document.
+func mongoVersionFilter(id string, version int64) bson.D {
+	filter := bson.D{{Key: "sessionid", Value: id}}
+	if version != 0 {
+		filter = append(filter, bson.E{Key: "version", Value: version})
+	}
+	return filter
+}
+
+// Touch implements Toucher, updating the updated and expiresAt fields only.
+func (b *MongoBackend) Touch(ctx context.Context, id string, updated, expiresAt time.Time) error {
+	res, err := b.db.UpdateOne(
+		ctx,
+		bson.D{{Key: "sessionid", Value: id}},
+		bson.D{{Key: "$set", Value: bson.D{
+			{Key: "updated", Value: updated},
+			{Key: "expiresAt", Value: expiresAt},
+		}}},
 	)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// Delete implements Backend.
+func (b *MongoBackend) Delete(ctx context.Context, id string) error {
+	_, err := b.db.DeleteOne(ctx, bson.D{{Key: "sessionid", Value: id}})
 
 	return err
 }
 
-func (s *MongoStore) load(session *sessions.Session) error {
-	var result SessionEntry
+// List implements Lister with a cursor over the collection, sorted by sessionid.
+// Session values are not fetched.
+func (b *MongoBackend) List(ctx context.Context, opts ListOptions) ([]SessionInfo, string, error) {
+	filter := bson.D{{Key: "expiresAt", Value: bson.D{{Key: "$gt", Value: time.Now()}}}}
+	if opts.Cursor != "" {
+		filter = append(filter, bson.E{Key: "sessionid", Value: bson.D{{Key: "$gt", Value: opts.Cursor}}})
+	}
+	if opts.Name != "" {
+		filter = append(filter, bson.E{Key: "name", Value: opts.Name})
+	}
+	if r := mongoRange(opts.CreatedAfter, opts.CreatedBefore); r != nil {
+		filter = append(filter, bson.E{Key: "created", Value: r})
+	}
+	if r := mongoRange(opts.UpdatedAfter, opts.UpdatedBefore); r != nil {
+		filter = append(filter, bson.E{Key: "updated", Value: r})
+	}
+
+	limit := opts.limit()
+	findOpts := options.Find().
+		SetSort(bson.D{{Key: "sessionid", Value: 1}}).
+		SetLimit(int64(limit + 1)).
+		SetProjection(mongoInfoProjection)
 
-	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
-	entry := SessionEntry{
-		SessionID: session.ID,
+	cursor, err := b.db.Find(ctx, filter, findOpts)
+	if err != nil {
+		return nil, "", err
 	}
-	res := s.db.FindOne(ctx, entry)
-	err := res.Decode(&result)
+	defer cursor.Close(ctx)
+
+	var infos []SessionInfo
+	for cursor.Next(ctx) {
+		var result SessionEntry
+		if err := cursor.Decode(&result); err != nil {
+			return nil, "", err
+		}
+
+		infos = append(infos, result.record().info())
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, "", err
+	}
+
+	var next string
+	if len(infos) > limit {
+		infos = infos[:limit]
+		next = infos[limit-1].ID
+	}
+
+	return infos, next, nil
+}
+
+// ListByUser implements UserIndexer using the userid index.
+// Sessions are saved with an empty userid when not bound to a user, an
+// empty userID matches none of them.
+func (b *MongoBackend) ListByUser(ctx context.Context, userID string) ([]SessionInfo, error) {
+	if userID == "" {
+		return nil, nil
+	}
+
+	filter := bson.D{
+		{Key: "userid", Value: userID},
+		{Key: "expiresAt", Value: bson.D{{Key: "$gt", Value: time.Now()}}},
+	}
+	return b.find(ctx, filter)
+}
+
+// find returns the sessions matching filter, without their values.
+func (b *MongoBackend) find(ctx context.Context, filter bson.D) ([]SessionInfo, error) {
+	cursor, err := b.db.Find(ctx, filter, options.Find().SetProjection(mongoInfoProjection))
 	if err != nil {
-		return (err)
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var infos []SessionInfo
+	for cursor.Next(ctx) {
+		var result SessionEntry
+		if err := cursor.Decode(&result); err != nil {
+			return nil, err
+		}
+		infos = append(infos, result.record().info())
 	}
 
-	return securecookie.DecodeMulti(session.Name(), string(result.Value), &session.Values, s.Codecs...)
+	return infos, cursor.Err()
 }
 
-func (s *MongoStore) erase(session *sessions.Session) error {
-	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
-	entry := SessionEntry{
-		SessionID: session.ID,
+// DeleteByUser implements UserIndexer.
+func (b *MongoBackend) DeleteByUser(ctx context.Context, userID string) error {
+	if userID == "" {
+		return nil
 	}
-	_, err := s.db.DeleteOne(ctx, entry)
 
+	_, err := b.db.DeleteMany(ctx, bson.D{{Key: "userid", Value: userID}})
 	return err
 }
+
+// mongoInfoProjection leaves the session values out of listings.
+var mongoInfoProjection = bson.D{
+	{Key: "value", Value: 0},
+	{Key: "data", Value: 0},
+	{Key: "values", Value: 0},
+}
+
+// mongoRange returns a filter on an exclusive time range, nil if both ends are zero.
+func mongoRange(after, before time.Time) bson.D {
+	var r bson.D
+	if !after.IsZero() {
+		r = append(r, bson.E{Key: "$gt", Value: after})
+	}
+	if !before.IsZero() {
+		r = append(r, bson.E{Key: "$lt", Value: before})
+	}
+	return r
+}
@@ -0,0 +1,43 @@
+package vagorillasessionsstores
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/bh90210/vagorillasessionsstores/storetest"
+	"github.com/gorilla/sessions"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Test MongoStore against the conformance suite. It needs a MongoDB server,
+// set MONGO_URI to run it, e.g. MONGO_URI=mongodb://localhost:27017.
+func TestMongoStoreConformance(t *testing.T) {
+	uri := os.Getenv("MONGO_URI")
+	if uri == "" {
+		t.Skip("MONGO_URI not set")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatal("failed to connect to MongoDB", err)
+	}
+	defer client.Disconnect(context.Background())
+
+	// A database of its own, dropped afterwards.
+	database := "sessions_test_" + newSessionID()[:8]
+	defer client.Database(database).Drop(context.Background())
+
+	store, err := NewMongoStore(client, database, "", []byte("some key"))
+	if err != nil {
+		t.Fatal("failed to create store", err)
+	}
+
+	storetest.RunConformance(t, func(t *testing.T, keyPairs ...[]byte) sessions.Store {
+		return NewStore(store.backend, keyPairs...)
+	})
+}
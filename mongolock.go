@@ -0,0 +1,60 @@
+package vagorillasessionsstores
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// mongoDuplicateKey is the MongoDB error code of unique index violations.
+const mongoDuplicateKey = 11000
+
+// TryLock implements Locker with a lease document per locked session in the
+// "<collection>_locks" collection, keyed by session ID. The lease is taken
+// over in a single upsert if it expired or token holds it, a lease held by
+// another token makes the upsert violate the _id index.
+func (b *MongoBackend) TryLock(ctx context.Context, id, token string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	filter := bson.D{
+		{Key: "_id", Value: id},
+		{Key: "$or", Value: bson.A{
+			bson.D{{Key: "token", Value: token}},
+			bson.D{{Key: "expiresAt", Value: bson.D{{Key: "$lte", Value: now}}}},
+		}},
+	}
+	update := bson.D{{Key: "$set", Value: bson.D{
+		{Key: "token", Value: token},
+		{Key: "expiresAt", Value: now.Add(ttl)},
+	}}}
+
+	_, err := b.locks.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if isMongoDuplicateKey(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Unlock implements Locker.
+func (b *MongoBackend) Unlock(ctx context.Context, id, token string) error {
+	_, err := b.locks.DeleteOne(ctx, bson.D{{Key: "_id", Value: id}, {Key: "token", Value: token}})
+	return err
+}
+
+// isMongoDuplicateKey reports whether err is a unique index violation.
+func isMongoDuplicateKey(err error) bool {
+	var we mongo.WriteException
+	if errors.As(err, &we) {
+		for _, e := range we.WriteErrors {
+			if e.Code == mongoDuplicateKey {
+				return true
+			}
+		}
+	}
+
+	var ce mongo.CommandError
+	return errors.As(err, &ce) && ce.Code == mongoDuplicateKey
+}
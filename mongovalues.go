@@ -0,0 +1,267 @@
+package vagorillasessionsstores
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// bsonTypes holds the types registered with RegisterBSONType().
+var bsonTypes = struct {
+	sync.RWMutex
+	byName map[string]reflect.Type
+	byType map[reflect.Type]string
+}{
+	byName: make(map[string]reflect.Type),
+	byType: make(map[reflect.Type]string),
+}
+
+// RegisterBSONType records the concrete type of value under name, like
+// gob.Register(), so session values of that type stored as native BSON
+// decode back to it. Values of unregistered types are stored as plain
+// BSON and come back as the driver's generic types, e.g. primitive.D
+// for structs.
+//
+// The name is stored with every value, it must not change once in use.
+// Registering two types under the same name panics.
+func RegisterBSONType(name string, value interface{}) {
+	t := reflect.TypeOf(value)
+
+	bsonTypes.Lock()
+	defer bsonTypes.Unlock()
+	if registered, ok := bsonTypes.byName[name]; ok && registered != t {
+		panic(fmt.Sprintf("vagorillasessionsstores: registering duplicate BSON type name %q for %s and %s", name, registered, t))
+	}
+	bsonTypes.byName[name] = t
+	bsonTypes.byType[t] = name
+}
+
+// bsonValue returns how v is stored: tagged with its type name as
+// {_t: name, _v: v} if the type is registered, as is otherwise.
+func bsonValue(v interface{}) interface{} {
+	bsonTypes.RLock()
+	name, ok := bsonTypes.byType[reflect.TypeOf(v)]
+	bsonTypes.RUnlock()
+	if !ok {
+		return v
+	}
+	return bson.D{{Key: "_t", Value: name}, {Key: "_v", Value: v}}
+}
+
+// checkBSONKey returns an error if key cannot name a field of the values subdocument.
+func checkBSONKey(key interface{}) (string, error) {
+	k, ok := key.(string)
+	switch {
+	case !ok:
+		return "", fmt.Errorf("session value key %v is a %T, not a string", key, key)
+	case k == "" || strings.Contains(k, ".") || strings.HasPrefix(k, "$"):
+		return "", fmt.Errorf("session value key %q is not a valid BSON field name", k)
+	}
+	return k, nil
+}
+
+// bsonValues returns the values subdocument storing values, sorted by key.
+func bsonValues(values map[interface{}]interface{}) (bson.D, error) {
+	doc := make(bson.D, 0, len(values))
+	for k, v := range values {
+		key, err := checkBSONKey(k)
+		if err != nil {
+			return nil, err
+		}
+		doc = append(doc, bson.E{Key: key, Value: bsonValue(v)})
+	}
+
+	sort.Slice(doc, func(i, j int) bool { return doc[i].Key < doc[j].Key })
+	return doc, nil
+}
+
+// decodeBSONValues decodes a stored values subdocument.
+func decodeBSONValues(raw bson.Raw) (map[interface{}]interface{}, error) {
+	elements, err := raw.Elements()
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[interface{}]interface{}, len(elements))
+	for _, e := range elements {
+		v, err := decodeBSONValue(e.Value())
+		if err != nil {
+			return nil, fmt.Errorf("session value %q: %w", e.Key(), err)
+		}
+		values[e.Key()] = v
+	}
+	return values, nil
+}
+
+// decodeBSONValue decodes a single stored value, into its registered type if it is tagged with one.
+func decodeBSONValue(rv bson.RawValue) (interface{}, error) {
+	if doc, ok := rv.DocumentOK(); ok {
+		name, _ := doc.Lookup("_t").StringValueOK()
+
+		bsonTypes.RLock()
+		t, registered := bsonTypes.byName[name]
+		bsonTypes.RUnlock()
+
+		if registered {
+			ptr := reflect.New(t)
+			if err := doc.Lookup("_v").Unmarshal(ptr.Interface()); err != nil {
+				return nil, err
+			}
+			return ptr.Elem().Interface(), nil
+		}
+	}
+
+	var v interface{}
+	err := rv.Unmarshal(&v)
+	return v, err
+}
+
+// diffBSONValues returns the updates turning the stored values subdocument
+// before into values: a $set of the changed keys and an $unset of the
+// removed ones. A missing subdocument is set as a whole.
+func diffBSONValues(before bson.Raw, values bson.D) (set, unset bson.D, err error) {
+	if before == nil {
+		return bson.D{{Key: "values", Value: values}}, nil, nil
+	}
+
+	kept := make(map[string]bool, len(values))
+	for _, e := range values {
+		kept[e.Key] = true
+
+		t, data, err := bson.MarshalValue(e.Value)
+		if err != nil {
+			return nil, nil, fmt.Errorf("session value %q: %w", e.Key, err)
+		}
+		old, err := before.LookupErr(e.Key)
+		if err == nil && old.Type == t && bytes.Equal(old.Value, data) {
+			continue
+		}
+		set = append(set, bson.E{Key: "values." + e.Key, Value: bson.RawValue{Type: t, Value: data}})
+	}
+
+	elements, err := before.Elements()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, e := range elements {
+		if !kept[e.Key()] {
+			unset = append(unset, bson.E{Key: "values." + e.Key(), Value: ""})
+		}
+	}
+
+	return set, unset, nil
+}
+
+// SetNativeValues sets MongoBackend.NativeValues, see there.
+// Sessions saved before keep their format until saved again.
+func (s *MongoStore) SetNativeValues(native bool) {
+	s.backend.NativeValues = native
+}
+
+// StoresValues implements ValueStorer, it returns NativeValues.
+func (b *MongoBackend) StoresValues() bool {
+	return b.NativeValues
+}
+
+// upsertValues writes rec with its values as a BSON subdocument to the
+// document stored under matchID, creating it if needed. The stored values
+// are read first, then the metadata and only the changed keys are written in
+// a single update of the version read, which is retried if another save
+// came in between. With a non-zero rec.Version that is a conflict instead.
+func (b *MongoBackend) upsertValues(ctx context.Context, matchID string, rec *Record) error {
+	values, err := bsonValues(rec.Values)
+	if err != nil {
+		return err
+	}
+
+	for attempt := 1; ; attempt++ {
+		var before SessionEntry
+		err := b.db.FindOne(
+			ctx,
+			bson.D{{Key: "sessionid", Value: matchID}},
+			options.FindOne().SetProjection(bson.D{{Key: "values", Value: 1}, {Key: "version", Value: 1}}),
+		).Decode(&before)
+		missing := err == mongo.ErrNoDocuments
+		if err != nil && !missing {
+			return err
+		}
+		if rec.Version != 0 && (missing || before.Version != rec.Version) {
+			return ErrConcurrentModification
+		}
+
+		set, unset, err := diffBSONValues(before.Values, values)
+		if err != nil {
+			return err
+		}
+		set = append(bson.D{
+			{Key: "sessionid", Value: rec.ID},
+			{Key: "name", Value: rec.Name},
+			{Key: "userid", Value: rec.UserID},
+			{Key: "updated", Value: rec.Updated},
+			{Key: "expiresAt", Value: rec.ExpiresAt},
+		}, set...)
+		// Drop the encoded values of sessions saved before NativeValues was set.
+		unset = append(bson.D{{Key: "value", Value: ""}, {Key: "data", Value: ""}}, unset...)
+
+		// Documents saved before versions were checked have none.
+		filt := mongoVersionFilter(matchID, before.Version)
+		if before.Version == 0 {
+			filt = append(filt, bson.E{Key: "version", Value: bson.D{{Key: "$exists", Value: false}}})
+		}
+
+		res, err := b.db.UpdateOne(
+			ctx,
+			filt,
+			bson.D{
+				{Key: "$set", Value: set},
+				{Key: "$unset", Value: unset},
+				{Key: "$setOnInsert", Value: bson.D{{Key: "created", Value: rec.Created}}},
+				{Key: "$inc", Value: bson.D{{Key: "version", Value: int64(1)}}},
+			},
+			options.Update().SetUpsert(missing),
+		)
+		switch {
+		case err == nil && (res.MatchedCount > 0 || res.UpsertedCount > 0):
+			rec.Version = before.Version + 1
+			return nil
+		case err != nil && !isMongoDuplicateKey(err):
+			return err
+		case rec.Version != 0 || attempt == maxMergeAttempts:
+			// Saved or created by another request since the values were read.
+			return ErrConcurrentModification
+		}
+	}
+}
+
+// FindByValue returns the live sessions whose value under key equals value.
+// It only finds sessions saved with NativeValues set. Indexes on the values
+// queried, e.g. values.cart_id, are left to the application.
+func (b *MongoBackend) FindByValue(ctx context.Context, key string, value interface{}) ([]SessionInfo, error) {
+	if _, err := checkBSONKey(key); err != nil {
+		return nil, err
+	}
+
+	filter := bson.D{
+		{Key: "values." + key, Value: bsonValue(value)},
+		{Key: "expiresAt", Value: bson.D{{Key: "$gt", Value: time.Now()}}},
+	}
+	return b.find(ctx, filter)
+}
+
+// FindByValue returns the live sessions whose value under key equals value,
+// see MongoBackend.FindByValue().
+func (s *MongoStore) FindByValue(ctx context.Context, key string, value interface{}) ([]SessionInfo, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	infos, err := s.backend.FindByValue(ctx, key, value)
+	return infos, backendError(s.backend, "find", err)
+}
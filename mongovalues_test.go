@@ -0,0 +1,62 @@
+package vagorillasessionsstores
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type bsonCart struct {
+	ID    string
+	Items int
+}
+
+// Test that session values survive the BSON subdocument encoding, registered types included
+func TestBSONValues(t *testing.T) {
+	RegisterBSONType("cart", bsonCart{})
+
+	values := map[interface{}]interface{}{
+		"foo":  "bar",
+		"cart": bsonCart{ID: "c1", Items: 2},
+	}
+	doc, err := bsonValues(values)
+	if err != nil {
+		t.Fatal("failed to encode values", err)
+	}
+	raw, err := bson.Marshal(doc)
+	if err != nil {
+		t.Fatal("failed to marshal values", err)
+	}
+
+	decoded, err := decodeBSONValues(raw)
+	if err != nil {
+		t.Fatal("failed to decode values", err)
+	}
+	if decoded["foo"] != "bar" || decoded["cart"] != (bsonCart{ID: "c1", Items: 2}) {
+		t.Fatalf("bad decoded values %v", decoded)
+	}
+
+	values["foo"] = "baz"
+	delete(values, "cart")
+	values["new"] = int32(1)
+	doc, err = bsonValues(values)
+	if err != nil {
+		t.Fatal("failed to encode values", err)
+	}
+	set, unset, err := diffBSONValues(raw, doc)
+	if err != nil {
+		t.Fatal("failed to diff values", err)
+	}
+	if len(set) != 2 || set[0].Key != "values.foo" || set[1].Key != "values.new" {
+		t.Fatalf("bad $set %v", set)
+	}
+	if len(unset) != 1 || unset[0].Key != "values.cart" {
+		t.Fatalf("bad $unset %v", unset)
+	}
+
+	for _, key := range []interface{}{42, "", "a.b", "$where"} {
+		if _, err := bsonValues(map[interface{}]interface{}{key: 1}); err == nil {
+			t.Fatalf("key %v should be rejected", key)
+		}
+	}
+}
@@ -0,0 +1,11 @@
+module github.com/bh90210/vagorillasessionsstores/promobserver
+
+go 1.15
+
+// The stores are used from this repository when developing the adapter.
+replace github.com/bh90210/vagorillasessionsstores => ../
+
+require (
+	github.com/bh90210/vagorillasessionsstores v0.0.0-00010101000000-000000000000
+	github.com/prometheus/client_golang v1.11.1
+)
@@ -0,0 +1,57 @@
+// Package promobserver exports the operations of a vagorillasessionsstores
+// Store as Prometheus metrics. It lives in its own module so that the
+// stores do not depend on the Prometheus client unless it is required.
+package promobserver
+
+import (
+	"time"
+
+	stores "github.com/bh90210/vagorillasessionsstores"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// New returns an Observer recording the operations of a store, to register
+// with a prometheus.Registerer. Metric names are prefixed with namespace,
+// which may be empty:
+//
+//	<namespace>_session_operations_total{backend, op, outcome}
+//	<namespace>_session_operation_duration_seconds{backend, op}
+func New(namespace string) *Observer {
+	return &Observer{
+		operations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "session_operations_total",
+			Help:      "Session store operations by back-end, operation and outcome.",
+		}, []string{"backend", "op", "outcome"}),
+		durations: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "session_operation_duration_seconds",
+			Help:      "Duration of session store operations by back-end and operation.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"backend", "op"}),
+	}
+}
+
+// Observer is a stores.Observer and a prometheus.Collector.
+type Observer struct {
+	operations *prometheus.CounterVec
+	durations  *prometheus.HistogramVec
+}
+
+// Observe implements stores.Observer.
+func (o *Observer) Observe(op, backend string, duration time.Duration, outcome stores.Outcome) {
+	o.operations.WithLabelValues(backend, op, string(outcome)).Inc()
+	o.durations.WithLabelValues(backend, op).Observe(duration.Seconds())
+}
+
+// Describe implements prometheus.Collector.
+func (o *Observer) Describe(ch chan<- *prometheus.Desc) {
+	o.operations.Describe(ch)
+	o.durations.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (o *Observer) Collect(ch chan<- prometheus.Metric) {
+	o.operations.Collect(ch)
+	o.durations.Collect(ch)
+}
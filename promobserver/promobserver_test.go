@@ -0,0 +1,51 @@
+package promobserver
+
+import (
+	"testing"
+	"time"
+
+	stores "github.com/bh90210/vagorillasessionsstores"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Test that observed operations are collected by a registry
+func TestObserver(t *testing.T) {
+	observer := New("app")
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(observer); err != nil {
+		t.Fatal("failed to register observer", err)
+	}
+
+	observer.Observe("load", "badger", time.Millisecond, stores.OutcomeOK)
+	observer.Observe("load", "badger", time.Millisecond, stores.OutcomeOK)
+	observer.Observe("load", "badger", time.Millisecond, stores.OutcomeExpired)
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal("failed to gather metrics", err)
+	}
+
+	counts := make(map[string]float64)
+	var observations uint64
+	for _, family := range families {
+		for _, m := range family.GetMetric() {
+			switch family.GetName() {
+			case "app_session_operations_total":
+				for _, label := range m.GetLabel() {
+					if label.GetName() == "outcome" {
+						counts[label.GetValue()] = m.GetCounter().GetValue()
+					}
+				}
+			case "app_session_operation_duration_seconds":
+				observations += m.GetHistogram().GetSampleCount()
+			}
+		}
+	}
+
+	if counts["ok"] != 2 || counts["expired"] != 1 {
+		t.Fatalf("unexpected operation counts %v", counts)
+	}
+	if observations != 3 {
+		t.Fatalf("expected 3 observed durations, got %d", observations)
+	}
+}
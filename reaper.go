@@ -0,0 +1,58 @@
+package vagorillasessionsstores
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// reaper runs a pass removing expired records in a goroutine, for back-ends
+// without native expiry.
+type reaper struct {
+	// stop cancels the goroutine and its pending pass, if started.
+	stop context.CancelFunc
+	done sync.WaitGroup
+}
+
+// start runs pass every interval until close() is called, unless already
+// started. Each pass is bounded by interval and its error, if any, is given
+// to onError, which may be nil.
+func (r *reaper) start(interval time.Duration, pass func(context.Context) error, onError func(error)) {
+	if r.stop != nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r.stop = cancel
+	r.done.Add(1)
+	go func() {
+		defer r.done.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				passCtx, cancel := context.WithTimeout(ctx, interval)
+				err := pass(passCtx)
+				cancel()
+				if err != nil && onError != nil && ctx.Err() == nil {
+					onError(err)
+				}
+			}
+		}
+	}()
+}
+
+// close stops the goroutine, cancelling a pending pass, and waits for it to
+// return. It does nothing if the reaper is not running.
+func (r *reaper) close() {
+	if r.stop != nil {
+		r.stop()
+		r.done.Wait()
+		r.stop = nil
+	}
+}
@@ -0,0 +1,497 @@
+package vagorillasessionsstores
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// NewRedisStore returns a new Redis backed store.
+// pool is a redigo connection pool to the Redis server.
+// If keyPrefix is left empty "" the default "session:" prefix is used.
+//
+// The server is pinged on start, an unreachable server returns an error.
+//
+// Keys are defined in pairs to allow key rotation, but the common case is
+// to set a single authentication key and optionally an encryption key.
+//
+// The first key in a pair is used for authentication and the second for
+// encryption. The encryption key can be set to nil or omitted in the last
+// pair, but the authentication key is required in all pairs.
+//
+// It is recommended to use an authentication key with 32 or 64 bytes.
+// The encryption key, if set, must be either 16, 24, or 32 bytes to select
+// AES-128, AES-192, or AES-256 modes.
+func NewRedisStore(pool *redis.Pool, keyPrefix string, keyPairs ...[]byte) (*RedisStore, error) {
+	backend := NewRedisBackend(pool, keyPrefix)
+	store := &RedisStore{
+		Store:   NewStore(backend, keyPairs...),
+		backend: backend,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := backend.Ping(ctx); err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// RedisStore stores sessions using Redis
+type RedisStore struct {
+	*Store
+	backend *RedisBackend
+}
+
+// Close closes the connection pool of the store.
+func (s *RedisStore) Close() error {
+	return s.backend.pool.Close()
+}
+
+// NewRedisBackend returns a Backend persisting sessions in Redis under keys
+// starting with keyPrefix, "session:" if empty.
+func NewRedisBackend(pool *redis.Pool, keyPrefix string) *RedisBackend {
+	if keyPrefix == "" {
+		keyPrefix = "session:"
+	}
+
+	return &RedisBackend{
+		pool:   pool,
+		prefix: keyPrefix,
+	}
+}
+
+// RedisBackend is a Backend storing sessions in Redis under prefix+ID keys.
+// Session expiry is enforced with key expiries, Redis removes expired
+// sessions by itself. Writes are checked with WATCH and sent as pipelined
+// MULTI/EXEC transactions.
+type RedisBackend struct {
+	pool   *redis.Pool
+	prefix string
+}
+
+// Name returns "redis".
+func (b *RedisBackend) Name() string {
+	return "redis"
+}
+
+// Ping checks that the server can be reached.
+func (b *RedisBackend) Ping(ctx context.Context) error {
+	conn, err := b.conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.do("PING")
+	return err
+}
+
+// redisConn is a connection of the pool bound to the context of an operation.
+type redisConn struct {
+	redis.Conn
+	ctx context.Context
+}
+
+// conn gets a connection from the pool, waiting for one at most until ctx is
+// done. Closing it unwatches keys and discards a transaction left pending.
+func (b *RedisBackend) conn(ctx context.Context) (redisConn, error) {
+	conn, err := b.pool.GetContext(ctx)
+	if err != nil {
+		return redisConn{}, err
+	}
+	return redisConn{Conn: conn, ctx: ctx}, nil
+}
+
+// do sends the command and the pipelined ones, if any, and returns the
+// reply of the last one. Replies are awaited until the context is done.
+func (c redisConn) do(cmd string, args ...interface{}) (interface{}, error) {
+	if err := c.ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var timeout time.Duration
+	if deadline, ok := c.ctx.Deadline(); ok {
+		// A zero timeout would wait for ever.
+		if timeout = time.Until(deadline); timeout <= 0 {
+			return nil, context.DeadlineExceeded
+		}
+	}
+	return redis.DoWithTimeout(c.Conn, timeout, cmd, args...)
+}
+
+// key returns the key of session id.
+func (b *RedisBackend) key(id string) string {
+	return b.prefix + id
+}
+
+// userKey returns the key indexing session id under userID. User IDs may
+// contain any character but NUL, which separates them from the session ID so
+// that the keys of a user do not prefix those of another.
+func (b *RedisBackend) userKey(userID, id string) string {
+	return b.prefix + "user:" + userID + "\x00" + id
+}
+
+// lockKey returns the key of the lock of session id.
+func (b *RedisBackend) lockKey(id string) string {
+	return b.prefix + "lock:" + id
+}
+
+// get returns the record stored under session id, nil if there is none.
+func (b *RedisBackend) get(conn redisConn, id string) (*Record, error) {
+	val, err := redis.Bytes(conn.do("GET", b.key(id)))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	entry, err := decodeJSONEntry(val)
+	if err != nil {
+		return nil, err
+	}
+	return entry.record(id), nil
+}
+
+// Load implements Backend.
+func (b *RedisBackend) Load(ctx context.Context, id string) (*Record, error) {
+	conn, err := b.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	rec, err := b.get(conn, id)
+	if err != nil {
+		return nil, err
+	}
+	if rec == nil {
+		return nil, ErrSessionNotFound
+	}
+	return rec, nil
+}
+
+// Save implements Backend.
+//
+// The session key is set with an expiry matching Options.MaxAge. Sessions
+// bound to a user are also indexed under a prefix+"user:"+userID+"\x00"+ID key
+// expiring together with the session. Versions are checked under WATCH, a
+// concurrent write makes the transaction fail with ErrConcurrentModification.
+func (b *RedisBackend) Save(ctx context.Context, rec *Record) error {
+	return b.put(ctx, rec.ID, rec)
+}
+
+// Rename implements Renamer in a single transaction.
+func (b *RedisBackend) Rename(ctx context.Context, oldID string, rec *Record) error {
+	return b.put(ctx, oldID, rec)
+}
+
+// put writes rec, replacing the record stored under oldID if its version is rec.Version.
+func (b *RedisBackend) put(ctx context.Context, oldID string, rec *Record) error {
+	conn, err := b.conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.do("WATCH", b.key(oldID)); err != nil {
+		return err
+	}
+	old, err := b.get(conn, oldID)
+	if err != nil {
+		return err
+	}
+
+	stored := *rec
+	stored.Version = 1
+	var del []interface{}
+	if old != nil {
+		if rec.Version != 0 && old.Version != rec.Version {
+			return ErrConcurrentModification
+		}
+		stored.Version = old.Version + 1
+		if !old.Created.IsZero() {
+			stored.Created = old.Created
+		}
+		if old.UserID != "" && (old.UserID != rec.UserID || oldID != rec.ID) {
+			del = append(del, b.userKey(old.UserID, oldID))
+		}
+		if oldID != rec.ID {
+			del = append(del, b.key(oldID))
+		}
+	} else if rec.Version != 0 {
+		// Deleted since it was loaded.
+		return ErrConcurrentModification
+	}
+
+	conn.Send("MULTI")
+	if len(del) > 0 {
+		conn.Send("DEL", del...)
+	}
+	if err := b.write(conn, &stored); err != nil {
+		return err
+	}
+	if err := redisExec(conn); err != nil {
+		return err
+	}
+	rec.Version = stored.Version
+	return nil
+}
+
+// write pipelines the commands setting the keys storing rec, with an expiry
+// matching its own.
+func (b *RedisBackend) write(conn redisConn, rec *Record) error {
+	val, err := json.Marshal(newJSONEntry(rec))
+	if err != nil {
+		return err
+	}
+
+	expiry := []interface{}{}
+	if !rec.ExpiresAt.IsZero() {
+		ms := time.Until(rec.ExpiresAt).Milliseconds()
+		if ms < 1 {
+			ms = 1
+		}
+		expiry = append(expiry, "PX", ms)
+	}
+
+	if err := conn.Send("SET", append([]interface{}{b.key(rec.ID), val}, expiry...)...); err != nil {
+		return err
+	}
+	if rec.UserID != "" {
+		return conn.Send("SET", append([]interface{}{b.userKey(rec.UserID, rec.ID), ""}, expiry...)...)
+	}
+	return nil
+}
+
+// redisExec executes the pipelined transaction. A transaction aborted by a
+// change to a watched key fails with ErrConcurrentModification.
+func redisExec(conn redisConn) error {
+	reply, err := conn.do("EXEC")
+	if err != nil {
+		return err
+	}
+	if reply == nil {
+		return ErrConcurrentModification
+	}
+	return nil
+}
+
+// Touch implements Toucher. Redis values carry their expiry, so the stored
+// entry is written again with its values as they are.
+func (b *RedisBackend) Touch(ctx context.Context, id string, updated, expiresAt time.Time) error {
+	conn, err := b.conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.do("WATCH", b.key(id)); err != nil {
+		return err
+	}
+	rec, err := b.get(conn, id)
+	if err != nil {
+		return err
+	}
+	if rec == nil {
+		return ErrSessionNotFound
+	}
+
+	// The values are unchanged, so is the version.
+	rec.Updated = updated
+	rec.ExpiresAt = expiresAt
+	conn.Send("MULTI")
+	if err := b.write(conn, rec); err != nil {
+		return err
+	}
+	return redisExec(conn)
+}
+
+// Delete implements Backend.
+func (b *RedisBackend) Delete(ctx context.Context, id string) error {
+	conn, err := b.conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	rec, err := b.get(conn, id)
+	if err != nil || rec == nil {
+		return err
+	}
+
+	keys := []interface{}{b.key(id)}
+	if rec.UserID != "" {
+		keys = append(keys, b.userKey(rec.UserID, id))
+	}
+	_, err = conn.do("DEL", keys...)
+	return err
+}
+
+// redisGlobEscaper escapes the characters of SCAN MATCH patterns.
+var redisGlobEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
+
+// userSessions returns the IDs of the sessions indexed under userID, by
+// scanning the keys of its index.
+func (b *RedisBackend) userSessions(conn redisConn, userID string) ([]string, error) {
+	prefix := b.userKey(userID, "")
+	pattern := redisGlobEscaper.Replace(prefix) + "*"
+
+	var ids []string
+	cursor := "0"
+	for {
+		reply, err := redis.Values(conn.do("SCAN", cursor, "MATCH", pattern, "COUNT", 1000))
+		if err != nil {
+			return nil, err
+		}
+		var keys []string
+		if _, err := redis.Scan(reply, &cursor, &keys); err != nil {
+			return nil, err
+		}
+
+		for _, key := range keys {
+			ids = append(ids, strings.TrimPrefix(key, prefix))
+		}
+		if cursor == "0" {
+			return ids, nil
+		}
+	}
+}
+
+// ListByUser implements UserIndexer using the user index keys.
+func (b *RedisBackend) ListByUser(ctx context.Context, userID string) ([]SessionInfo, error) {
+	conn, err := b.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	ids, err := b.userSessions(conn, userID)
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+
+	keys := make([]interface{}, len(ids))
+	for i, id := range ids {
+		keys[i] = b.key(id)
+	}
+	vals, err := redis.ByteSlices(conn.do("MGET", keys...))
+	if err != nil {
+		return nil, err
+	}
+
+	var infos []SessionInfo
+	for i, val := range vals {
+		// Expired or deleted since the scan.
+		if val == nil {
+			continue
+		}
+
+		entry, err := decodeJSONEntry(val)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, entry.record(ids[i]).info())
+	}
+
+	return infos, nil
+}
+
+// DeleteByUser implements UserIndexer, deleting all sessions of userID in one command.
+func (b *RedisBackend) DeleteByUser(ctx context.Context, userID string) error {
+	conn, err := b.conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ids, err := b.userSessions(conn, userID)
+	if err != nil || len(ids) == 0 {
+		return err
+	}
+
+	keys := make([]interface{}, 0, 2*len(ids))
+	for _, id := range ids {
+		keys = append(keys, b.key(id), b.userKey(userID, id))
+	}
+	_, err = conn.do("DEL", keys...)
+	return err
+}
+
+// TryLock implements Locker with a prefix+"lock:"+ID key holding the token
+// and expiring with the lease. It is set with SET NX, the holder extends it
+// under WATCH.
+func (b *RedisBackend) TryLock(ctx context.Context, id, token string, ttl time.Duration) (bool, error) {
+	conn, err := b.conn(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	key := b.lockKey(id)
+	ms := ttl.Milliseconds()
+	if ms < 1 {
+		ms = 1
+	}
+	reply, err := conn.do("SET", key, token, "NX", "PX", ms)
+	if err != nil || reply != nil {
+		return err == nil, err
+	}
+
+	if _, err := conn.do("WATCH", key); err != nil {
+		return false, err
+	}
+	holder, err := redis.String(conn.do("GET", key))
+	if err == redis.ErrNil {
+		// Released meanwhile, the next attempt sets it.
+		return false, nil
+	}
+	if err != nil || holder != token {
+		return false, err
+	}
+
+	conn.Send("MULTI")
+	conn.Send("SET", key, token, "PX", ms)
+	if err := redisExec(conn); err != nil {
+		if err == ErrConcurrentModification {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// Unlock implements Locker.
+func (b *RedisBackend) Unlock(ctx context.Context, id, token string) error {
+	conn, err := b.conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	key := b.lockKey(id)
+	if _, err := conn.do("WATCH", key); err != nil {
+		return err
+	}
+	holder, err := redis.String(conn.do("GET", key))
+	if err == redis.ErrNil {
+		return nil
+	}
+	if err != nil || holder != token {
+		return err
+	}
+
+	conn.Send("MULTI")
+	conn.Send("DEL", key)
+	err = redisExec(conn)
+	if err == ErrConcurrentModification {
+		// Expired and taken by another holder meanwhile.
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,244 @@
+package vagorillasessionsstores
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/bh90210/vagorillasessionsstores/storetest"
+	"github.com/gomodule/redigo/redis"
+	"github.com/gorilla/sessions"
+)
+
+// newTestRedisStore returns a RedisStore on a fakeRedis.
+func newTestRedisStore(t *testing.T) *RedisStore {
+	store, err := NewRedisStore(newFakeRedis(t), "", []byte("some key"))
+	if err != nil {
+		t.Fatal("failed to create store", err)
+	}
+	return store
+}
+
+// Test RedisStore against the conformance suite, on a fakeRedis unless
+// REDIS_ADDR is set to the address of a Redis server, e.g.
+// REDIS_ADDR=127.0.0.1:6379. Keys are prefixed to keep them apart.
+func TestRedisStoreConformance(t *testing.T) {
+	var store *RedisStore
+	if addr := os.Getenv("REDIS_ADDR"); addr != "" {
+		pool := &redis.Pool{
+			MaxIdle: 4,
+			Dial: func() (redis.Conn, error) {
+				return redis.Dial("tcp", addr)
+			},
+		}
+
+		var err error
+		store, err = NewRedisStore(pool, "sessions_test_"+newSessionID()[:8]+":", []byte("some key"))
+		if err != nil {
+			t.Fatal("failed to create store", err)
+		}
+		defer store.Close()
+	} else {
+		store = newTestRedisStore(t)
+	}
+
+	storetest.RunConformance(t, func(t *testing.T, keyPairs ...[]byte) sessions.Store {
+		return NewStore(store.backend, keyPairs...)
+	})
+}
+
+// Test a redis session round trip through http
+func TestRedisStore(t *testing.T) {
+	store := newTestRedisStore(t)
+
+	req, err := http.NewRequest("GET", "http://www.example.com", nil)
+	if err != nil {
+		t.Fatal("failed to create request", err)
+	}
+	session, err := store.New(req, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	session.Values["foo"] = "bar"
+
+	w := httptest.NewRecorder()
+	if err := session.Save(req, w); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	req.Header.Add("Cookie", w.Header().Get("Set-Cookie"))
+
+	session, err = store.New(req, "hello")
+	if err != nil {
+		t.Fatal("failed to load session", err)
+	}
+	if session.IsNew || session.Values["foo"] != "bar" {
+		t.Fatalf("session not loaded: IsNew %v, values %v", session.IsNew, session.Values)
+	}
+
+	// The key expires with the session.
+	conn := store.backend.pool.Get()
+	defer conn.Close()
+	ttl, err := redis.Int64(conn.Do("PTTL", "session:"+session.ID))
+	if err != nil {
+		t.Fatal("failed to get the key expiry", err)
+	}
+	if ttl <= 0 || ttl > int64(session.Options.MaxAge)*1000 {
+		t.Fatalf("expected the key to expire in MaxAge, got %dms", ttl)
+	}
+
+	session.Options.MaxAge = -1
+	if err := session.Save(req, httptest.NewRecorder()); err != nil {
+		t.Fatal("failed to delete session", err)
+	}
+	if ok, err := store.Exists(context.Background(), session.ID); err != nil || ok {
+		t.Fatalf("session not deleted: exists %v, %v", ok, err)
+	}
+}
+
+// Test listing, revoking and renaming the redis sessions of users
+func TestRedisStoreUsers(t *testing.T) {
+	store := newTestRedisStore(t)
+
+	ctx := context.Background()
+	var ids []string
+	// The user ID holds glob characters and the user ID of another user
+	// starts with it, neither must match other users.
+	for _, userID := range []string{"a*", "a*", "ab", "a*:b"} {
+		session := sessions.NewSession(store, "hello")
+		session.Options = &sessions.Options{MaxAge: 60}
+		SetUserID(session, userID)
+		if err := store.SaveByID(ctx, session); err != nil {
+			t.Fatal("failed to save session", err)
+		}
+		ids = append(ids, session.ID)
+	}
+
+	if _, _, err := store.List(ctx, ListOptions{}); err != ErrNotSupported {
+		t.Fatalf("expected ErrNotSupported, got %v", err)
+	}
+
+	infos, err := store.ListSessionsForUser(ctx, "a*")
+	if err != nil {
+		t.Fatal("failed to list sessions", err)
+	}
+	if len(infos) != 2 || infos[0].UserID != "a*" || infos[1].UserID != "a*" {
+		t.Fatalf("expected 2 sessions of a*, got %+v", infos)
+	}
+
+	req, err := http.NewRequest("GET", "http://www.example.com", nil)
+	if err != nil {
+		t.Fatal("failed to create request", err)
+	}
+	session, err := store.LoadByID(ctx, "hello", ids[0])
+	if err != nil {
+		t.Fatal("failed to load session", err)
+	}
+	if err := store.RegenerateID(req, httptest.NewRecorder(), session); err != nil {
+		t.Fatal("failed to regenerate session ID", err)
+	}
+	if ok, _ := store.Exists(ctx, ids[0]); ok {
+		t.Fatal("old session not deleted")
+	}
+	if _, err := store.LoadByID(ctx, "hello", session.ID); err != nil {
+		t.Fatal("failed to load renamed session", err)
+	}
+
+	if err := store.RevokeAllForUser(ctx, "a*"); err != nil {
+		t.Fatal("failed to revoke sessions", err)
+	}
+	for i, id := range []string{session.ID, ids[1], ids[2], ids[3]} {
+		ok, err := store.Exists(ctx, id)
+		if err != nil {
+			t.Fatal("failed to check session", err)
+		}
+		if ok != (i >= 2) {
+			t.Fatalf("session %d: exists %v", i, ok)
+		}
+	}
+	if infos, err := store.ListSessionsForUser(ctx, "a*:b"); err != nil || len(infos) != 1 {
+		t.Fatalf("expected the session of a*:b still indexed, got %+v %v", infos, err)
+	}
+}
+
+// Test that a redis session saved concurrently since it was loaded is not overwritten
+func TestRedisStoreConcurrentModification(t *testing.T) {
+	store := newTestRedisStore(t)
+
+	ctx := context.Background()
+	session := sessions.NewSession(store, "hello")
+	session.Options = &sessions.Options{MaxAge: 60}
+	if err := store.SaveByID(ctx, session); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+
+	first, err := store.LoadByID(ctx, "hello", session.ID)
+	if err != nil {
+		t.Fatal("failed to load session", err)
+	}
+	second, err := store.LoadByID(ctx, "hello", session.ID)
+	if err != nil {
+		t.Fatal("failed to load session", err)
+	}
+
+	first.Values["a"] = "1"
+	if err := store.SaveByID(ctx, first); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	second.Values["b"] = "2"
+	if err := store.SaveByID(ctx, second); !errors.Is(err, ErrConcurrentModification) {
+		t.Fatalf("expected ErrConcurrentModification, got %v", err)
+	}
+}
+
+// Test touching and locking redis sessions
+func TestRedisStoreTouchLock(t *testing.T) {
+	store := newTestRedisStore(t)
+
+	ctx := context.Background()
+	session := sessions.NewSession(store, "hello")
+	session.Options = &sessions.Options{MaxAge: 1}
+	if err := store.SaveByID(ctx, session); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	session.Options.MaxAge = 60
+	if err := store.Touch(ctx, session); err != nil {
+		t.Fatal("failed to touch session", err)
+	}
+	missing := sessions.NewSession(store, "hello")
+	missing.ID = "missing"
+	if err := store.Touch(ctx, missing); err != ErrSessionNotFound {
+		t.Fatalf("expected ErrSessionNotFound, got %v", err)
+	}
+
+	lock, err := store.Lock(ctx, session.ID, time.Second)
+	if err != nil {
+		t.Fatal("failed to lock session", err)
+	}
+	if err := lock.Extend(ctx, time.Second); err != nil {
+		t.Fatal("failed to extend lock", err)
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel()
+	if _, err := store.Lock(waitCtx, session.ID, time.Second); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the second lock to time out, got %v", err)
+	}
+	if err := lock.Unlock(ctx); err != nil {
+		t.Fatal("failed to unlock session", err)
+	}
+	if _, err := store.Lock(ctx, session.ID, 100*time.Millisecond); err != nil {
+		t.Fatal("failed to lock unlocked session", err)
+	}
+
+	// The session outlives its first MaxAge and the lock its lease.
+	time.Sleep(1100 * time.Millisecond)
+	if ok, err := store.Exists(ctx, session.ID); err != nil || !ok {
+		t.Fatalf("touched session expired: exists %v, %v", ok, err)
+	}
+	if _, err := store.Lock(ctx, session.ID, time.Second); err != nil {
+		t.Fatal("failed to lock session after the lease ran out", err)
+	}
+}
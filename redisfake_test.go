@@ -0,0 +1,392 @@
+package vagorillasessionsstores
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// newFakeRedis starts a fakeRedis on a loopback port and returns a pool of
+// connections to it. Both are closed when the test ends.
+func newFakeRedis(t *testing.T) *redis.Pool {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("failed to listen", err)
+	}
+	server := &fakeRedis{keys: make(map[string]*fakeRedisKey)}
+	go server.serve(lis)
+
+	pool := &redis.Pool{
+		MaxIdle: 4,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", lis.Addr().String())
+		},
+	}
+
+	t.Cleanup(func() {
+		pool.Close()
+		lis.Close()
+	})
+	return pool
+}
+
+// fakeRedis is an in-process server speaking the Redis protocol. It knows
+// the commands sent by RedisBackend: PING, GET, SET with NX, PX and EX, DEL,
+// MGET, SCAN with MATCH, WATCH, UNWATCH, MULTI, EXEC and DISCARD, and PTTL
+// for tests. Keys expire lazily, when they are next read.
+type fakeRedis struct {
+	mu   sync.Mutex
+	keys map[string]*fakeRedisKey
+	// writes counts the writes, so that watched keys can tell if they changed.
+	writes uint64
+}
+
+type fakeRedisKey struct {
+	value     string
+	expiresAt time.Time
+	// written is the write that set the key.
+	written uint64
+}
+
+// fakeRedisConn is the state of a client connection.
+type fakeRedisConn struct {
+	// watched holds the watched keys and the write that last set them, 0 if unset.
+	watched map[string]uint64
+	// queued holds the commands of an open transaction, nil if none is.
+	queued [][]string
+}
+
+func (f *fakeRedis) serve(lis net.Listener) {
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		go f.handle(conn)
+	}
+}
+
+func (f *fakeRedis) handle(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	state := &fakeRedisConn{}
+	for {
+		cmd, err := readFakeRedisCommand(r)
+		if err != nil {
+			return
+		}
+		writeFakeRedisReply(w, f.run(state, cmd))
+		// Pipelined commands are answered together.
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// readFakeRedisCommand reads a command sent as an array of bulk strings.
+func readFakeRedisCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readFakeRedisLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, fmt.Errorf("unexpected %q", line)
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := make([]string, n)
+	for i := range cmd {
+		line, err := readFakeRedisLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, fmt.Errorf("unexpected %q", line)
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		cmd[i] = string(buf[:size])
+	}
+	return cmd, nil
+}
+
+func readFakeRedisLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	return strings.TrimSuffix(line, "\r\n"), err
+}
+
+// fakeRedisStatus and fakeRedisError are simple string and error replies,
+// a nil reply is a null bulk string and a nil []interface{} a null array.
+type (
+	fakeRedisStatus string
+	fakeRedisError  string
+)
+
+func writeFakeRedisReply(w *bufio.Writer, reply interface{}) {
+	switch reply := reply.(type) {
+	case fakeRedisStatus:
+		fmt.Fprintf(w, "+%s\r\n", reply)
+	case fakeRedisError:
+		fmt.Fprintf(w, "-%s\r\n", reply)
+	case int:
+		fmt.Fprintf(w, ":%d\r\n", reply)
+	case string:
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(reply), reply)
+	case nil:
+		w.WriteString("$-1\r\n")
+	case []interface{}:
+		if reply == nil {
+			w.WriteString("*-1\r\n")
+			return
+		}
+		fmt.Fprintf(w, "*%d\r\n", len(reply))
+		for _, r := range reply {
+			writeFakeRedisReply(w, r)
+		}
+	default:
+		panic(fmt.Sprintf("unexpected reply %T", reply))
+	}
+}
+
+// run runs or queues cmd for the connection.
+func (f *fakeRedis) run(state *fakeRedisConn, cmd []string) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	name := strings.ToUpper(cmd[0])
+	switch name {
+	case "MULTI":
+		if state.queued != nil {
+			return fakeRedisError("ERR MULTI calls can not be nested")
+		}
+		state.queued = [][]string{}
+		return fakeRedisStatus("OK")
+	case "EXEC":
+		if state.queued == nil {
+			return fakeRedisError("ERR EXEC without MULTI")
+		}
+		queued := state.queued
+		changed := f.changed(state.watched)
+		state.queued, state.watched = nil, nil
+		if changed {
+			return []interface{}(nil)
+		}
+		replies := []interface{}{}
+		for _, cmd := range queued {
+			replies = append(replies, f.exec(cmd))
+		}
+		return replies
+	case "DISCARD":
+		if state.queued == nil {
+			return fakeRedisError("ERR DISCARD without MULTI")
+		}
+		state.queued, state.watched = nil, nil
+		return fakeRedisStatus("OK")
+	case "WATCH":
+		if state.queued != nil {
+			return fakeRedisError("ERR WATCH inside MULTI is not allowed")
+		}
+		if state.watched == nil {
+			state.watched = make(map[string]uint64)
+		}
+		for _, key := range cmd[1:] {
+			state.watched[key] = 0
+			if k := f.get(key); k != nil {
+				state.watched[key] = k.written
+			}
+		}
+		return fakeRedisStatus("OK")
+	case "UNWATCH":
+		state.watched = nil
+		return fakeRedisStatus("OK")
+	}
+
+	if state.queued != nil {
+		state.queued = append(state.queued, cmd)
+		return fakeRedisStatus("QUEUED")
+	}
+	return f.exec(cmd)
+}
+
+// changed reports whether a watched key was written or expired.
+func (f *fakeRedis) changed(watched map[string]uint64) bool {
+	for key, written := range watched {
+		var current uint64
+		if k := f.get(key); k != nil {
+			current = k.written
+		}
+		if current != written {
+			return true
+		}
+	}
+	return false
+}
+
+// get returns the live key, removing it if it expired.
+func (f *fakeRedis) get(key string) *fakeRedisKey {
+	k, ok := f.keys[key]
+	if !ok {
+		return nil
+	}
+	if !k.expiresAt.IsZero() && !time.Now().Before(k.expiresAt) {
+		delete(f.keys, key)
+		return nil
+	}
+	return k
+}
+
+// exec runs a data command.
+func (f *fakeRedis) exec(cmd []string) interface{} {
+	args := cmd[1:]
+	switch strings.ToUpper(cmd[0]) {
+	case "PING":
+		return fakeRedisStatus("PONG")
+
+	case "GET":
+		if len(args) != 1 {
+			return fakeRedisError("ERR wrong number of arguments for 'get' command")
+		}
+		if k := f.get(args[0]); k != nil {
+			return k.value
+		}
+		return nil
+
+	case "PTTL":
+		if len(args) != 1 {
+			return fakeRedisError("ERR wrong number of arguments for 'pttl' command")
+		}
+		k := f.get(args[0])
+		switch {
+		case k == nil:
+			return -2
+		case k.expiresAt.IsZero():
+			return -1
+		}
+		return int(time.Until(k.expiresAt).Milliseconds())
+
+	case "MGET":
+		values := make([]interface{}, len(args))
+		for i, key := range args {
+			if k := f.get(key); k != nil {
+				values[i] = k.value
+			}
+		}
+		return values
+
+	case "SET":
+		if len(args) < 2 {
+			return fakeRedisError("ERR wrong number of arguments for 'set' command")
+		}
+		var nx bool
+		var expiresAt time.Time
+		for i := 2; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "NX":
+				nx = true
+			case "PX", "EX":
+				if i+1 == len(args) {
+					return fakeRedisError("ERR syntax error")
+				}
+				n, err := strconv.ParseInt(args[i+1], 10, 64)
+				if err != nil || n <= 0 {
+					return fakeRedisError("ERR invalid expire time in 'set' command")
+				}
+				unit := time.Millisecond
+				if strings.ToUpper(args[i]) == "EX" {
+					unit = time.Second
+				}
+				expiresAt = time.Now().Add(time.Duration(n) * unit)
+				i++
+			default:
+				return fakeRedisError("ERR syntax error")
+			}
+		}
+		if nx && f.get(args[0]) != nil {
+			return nil
+		}
+		f.writes++
+		f.keys[args[0]] = &fakeRedisKey{value: args[1], expiresAt: expiresAt, written: f.writes}
+		return fakeRedisStatus("OK")
+
+	case "DEL":
+		deleted := 0
+		for _, key := range args {
+			if f.get(key) != nil {
+				f.writes++
+				delete(f.keys, key)
+				deleted++
+			}
+		}
+		return deleted
+
+	case "SCAN":
+		// All keys are returned at once, with a final cursor.
+		var pattern string
+		for i := 1; i+1 < len(args); i += 2 {
+			if strings.ToUpper(args[i]) == "MATCH" {
+				pattern = args[i+1]
+			}
+		}
+		keys := []interface{}{}
+		for key := range f.keys {
+			if f.get(key) != nil && (pattern == "" || fakeRedisMatch(pattern, key)) {
+				keys = append(keys, key)
+			}
+		}
+		return []interface{}{"0", keys}
+	}
+
+	return fakeRedisError(fmt.Sprintf("ERR unknown command '%s'", cmd[0]))
+}
+
+// fakeRedisMatch reports whether s matches the glob pattern, with * and ?
+// wildcards and backslash escapes. Character classes are not supported.
+func fakeRedisMatch(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(s); i >= 0; i-- {
+				if fakeRedisMatch(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if s == "" {
+				return false
+			}
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if s == "" || s[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern, s = pattern[1:], s[1:]
+	}
+	return s == ""
+}
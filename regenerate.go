@@ -0,0 +1,73 @@
+package vagorillasessionsstores
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// Renamer is implemented by back-ends able to move a session to a new ID atomically.
+type Renamer interface {
+	// Rename stores rec under rec.ID and removes the record stored under oldID
+	// in a single operation. The creation time of the old record is kept.
+	Rename(ctx context.Context, oldID string, rec *Record) error
+}
+
+// RegenerateID moves session to a new random ID and re-issues the cookie.
+// Call it on login and on every privilege change to prevent session fixation.
+//
+// The record under the old ID is removed in the same operation when the
+// back-end implements Renamer, otherwise it is deleted right after the new
+// record is saved. A session that was never saved is simply saved.
+func (s *Store) RegenerateID(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.ID == "" || session.Options.MaxAge <= 0 {
+		return s.Save(r, w, session)
+	}
+
+	oldID := session.ID
+	session.ID = newSessionID()
+	if err := s.rename(r.Context(), oldID, session); err != nil {
+		session.ID = oldID
+		return err
+	}
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID,
+		s.Codecs...)
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+func (s *Store) rename(ctx context.Context, oldID string, session *sessions.Session) (err error) {
+	ctx, done := s.start(ctx, "regenerate", session.Name())
+	defer func() { done(err) }()
+
+	rec, err := s.record(session)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	if renamer, ok := s.backend.(Renamer); ok {
+		if err := renamer.Rename(ctx, oldID, rec); err != nil {
+			return backendError(s.backend, "save", err)
+		}
+		setVersion(session, rec.Version)
+		return nil
+	}
+
+	// The record under the new ID does not exist yet, there is no version to check.
+	rec.Version = 0
+	if err := s.backend.Save(ctx, rec); err != nil {
+		return backendError(s.backend, "save", err)
+	}
+	setVersion(session, rec.Version)
+	return backendError(s.backend, "delete", s.backend.Delete(ctx, oldID))
+}
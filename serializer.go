@@ -0,0 +1,183 @@
+package vagorillasessionsstores
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Serializer encodes session values for storage in a Backend.
+type Serializer interface {
+	Serialize(values map[interface{}]interface{}) ([]byte, error)
+	// Deserialize decodes data into values.
+	Deserialize(data []byte, values map[interface{}]interface{}) error
+}
+
+// ValueStorer is implemented by back-ends able to store session values
+// natively, such as MongoBackend with NativeValues set.
+type ValueStorer interface {
+	// StoresValues reports whether Save expects Record.Values instead of an
+	// encoded Record.Value. Serializer and ValueCodecs are not used then.
+	StoresValues() bool
+}
+
+// GobSerializer encodes session values with encoding/gob.
+// Custom types must be registered with gob.Register().
+type GobSerializer struct{}
+
+// Serialize implements Serializer.
+func (GobSerializer) Serialize(values map[interface{}]interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(values); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Deserialize implements Serializer.
+func (GobSerializer) Deserialize(data []byte, values map[interface{}]interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(&values)
+}
+
+// JSONSerializer encodes session values as a JSON object, readable by
+// non-Go services. Keys must be strings. Values come back as the types
+// encoding/json decodes to, e.g. numbers as float64.
+type JSONSerializer struct{}
+
+// Serialize implements Serializer.
+func (JSONSerializer) Serialize(values map[interface{}]interface{}) ([]byte, error) {
+	m, err := stringKeys(values)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(m)
+}
+
+// Deserialize implements Serializer.
+func (JSONSerializer) Deserialize(data []byte, values map[interface{}]interface{}) error {
+	var m map[string]interface{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return err
+	}
+
+	for k, v := range m {
+		values[k] = v
+	}
+	return nil
+}
+
+// MsgpackSerializer encodes session values with MessagePack, a compact
+// binary format with implementations in most languages. Keys must be strings.
+type MsgpackSerializer struct{}
+
+// Serialize implements Serializer.
+func (MsgpackSerializer) Serialize(values map[interface{}]interface{}) ([]byte, error) {
+	m, err := stringKeys(values)
+	if err != nil {
+		return nil, err
+	}
+	return msgpack.Marshal(m)
+}
+
+// Deserialize implements Serializer.
+func (MsgpackSerializer) Deserialize(data []byte, values map[interface{}]interface{}) error {
+	var m map[string]interface{}
+	if err := msgpack.Unmarshal(data, &m); err != nil {
+		return err
+	}
+
+	for k, v := range m {
+		values[k] = v
+	}
+	return nil
+}
+
+// stringKeys converts values to a map with string keys for formats that only support those.
+func stringKeys(values map[interface{}]interface{}) (map[string]interface{}, error) {
+	m := make(map[string]interface{}, len(values))
+	for k, v := range values {
+		key, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("session value key %v is a %T, not a string", k, k)
+		}
+		m[key] = v
+	}
+	return m, nil
+}
+
+// NewValueCodecs returns codecs authenticating and optionally encrypting
+// serialized session values at rest, for Store.ValueCodecs.
+//
+// Keys are given in pairs like for the store's cookie codecs, but should
+// be different keys. The codecs do not expire values, the back-end does,
+// nor limit their length like a cookie's.
+func NewValueCodecs(keyPairs ...[]byte) []securecookie.Codec {
+	codecs := securecookie.CodecsFromPairs(keyPairs...)
+	for _, codec := range codecs {
+		if sc, ok := codec.(*securecookie.SecureCookie); ok {
+			sc.SetSerializer(securecookie.NopEncoder{})
+			sc.MaxAge(0)
+			sc.MaxLength(0)
+		}
+	}
+	return codecs
+}
+
+// encode returns the stored form of the session values.
+func (s *Store) encode(session *sessions.Session) ([]byte, error) {
+	values := storedValues(session.Values)
+
+	if s.Serializer == nil {
+		encoded, err := securecookie.EncodeMulti(session.Name(), values,
+			restCodecs(s.Codecs)...)
+		return []byte(encoded), err
+	}
+
+	data, err := s.Serializer.Serialize(values)
+	if err != nil || len(s.ValueCodecs) == 0 {
+		return data, err
+	}
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), data,
+		restCodecs(s.ValueCodecs)...)
+	return []byte(encoded), err
+}
+
+// decode decodes the stored form of the session values into session.
+func (s *Store) decode(session *sessions.Session, data []byte) error {
+	if s.Serializer == nil {
+		return securecookie.DecodeMulti(session.Name(), string(data), &session.Values, restCodecs(s.Codecs)...)
+	}
+
+	if len(s.ValueCodecs) > 0 {
+		var decoded []byte
+		if err := securecookie.DecodeMulti(session.Name(), string(data), &decoded, restCodecs(s.ValueCodecs)...); err != nil {
+			return err
+		}
+		data = decoded
+	}
+
+	return s.Serializer.Deserialize(data, session.Values)
+}
+
+// restCodecs returns codecs encoding and decoding values at rest like codecs,
+// without the limits meant for cookies: the length of the values is up to
+// the back-end, and their timestamp is ignored. It is the time the values
+// were last written, which Store.Touch() does not update: the expiry of
+// stored sessions is up to the back-end.
+func restCodecs(codecs []securecookie.Codec) []securecookie.Codec {
+	rest := make([]securecookie.Codec, len(codecs))
+	for i, codec := range codecs {
+		if sc, ok := codec.(*securecookie.SecureCookie); ok {
+			c := *sc
+			codec = c.MaxAge(0).MaxLength(0)
+		}
+		rest[i] = codec
+	}
+	return rest
+}
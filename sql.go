@@ -0,0 +1,391 @@
+package vagorillasessionsstores
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// NewSQLStore returns a new store keeping sessions in a table of db, a
+// database/sql handle opened with the driver matching dialect, e.g.
+// PostgresDialect{}. If tableName is left empty "" a default "sessions"
+// named table is used. Create it with Migrate().
+//
+// The database is pinged on start, an unreachable database returns an error.
+//
+// Keys are defined in pairs to allow key rotation, but the common case is
+// to set a single authentication key and optionally an encryption key.
+//
+// The first key in a pair is used for authentication and the second for
+// encryption. The encryption key can be set to nil or omitted in the last
+// pair, but the authentication key is required in all pairs.
+//
+// It is recommended to use an authentication key with 32 or 64 bytes.
+// The encryption key, if set, must be either 16, 24, or 32 bytes to select
+// AES-128, AES-192, or AES-256 modes.
+func NewSQLStore(db *sql.DB, dialect Dialect, tableName string, keyPairs ...[]byte) (*SQLStore, error) {
+	backend := NewSQLBackend(db, dialect, tableName)
+	store := &SQLStore{
+		Store:   NewStore(backend, keyPairs...),
+		backend: backend,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// SQLStore stores sessions using a SQL database
+type SQLStore struct {
+	*Store
+	backend *SQLBackend
+}
+
+// Migrate creates the sessions table, see SQLBackend.Migrate().
+func (s *SQLStore) Migrate(ctx context.Context) error {
+	return s.backend.Migrate(ctx)
+}
+
+// DeleteExpired deletes the expired sessions, see SQLBackend.DeleteExpired().
+func (s *SQLStore) DeleteExpired(ctx context.Context) (int64, error) {
+	return s.backend.DeleteExpired(ctx)
+}
+
+// StartReaper starts a goroutine deleting expired sessions every interval.
+// See SQLBackend.StartReaper().
+func (s *SQLStore) StartReaper(interval time.Duration) {
+	s.backend.StartReaper(interval)
+}
+
+// SetOnReapError sets SQLBackend.OnReapError, see there.
+func (s *SQLStore) SetOnReapError(onError func(error)) {
+	s.backend.OnReapError = onError
+}
+
+// Close stops the reaper if it was started. The database is left open.
+func (s *SQLStore) Close() error {
+	return s.backend.Close()
+}
+
+// NewSQLBackend returns a Backend persisting sessions in the table called
+// tableName, "sessions" if empty, of db. Statements are written for dialect.
+func NewSQLBackend(db *sql.DB, dialect Dialect, tableName string) *SQLBackend {
+	if tableName == "" {
+		tableName = "sessions"
+	}
+
+	return &SQLBackend{
+		db:      db,
+		dialect: dialect,
+		table:   tableName,
+	}
+}
+
+// SQLBackend is a Backend storing one row per session in a SQL table. Rows
+// are not removed when they expire, run DeleteExpired() or the reaper.
+type SQLBackend struct {
+	db      *sql.DB
+	dialect Dialect
+	table   string
+
+	// OnReapError is called with the errors of the passes of the reaper, see
+	// StartReaper(). Errors are dropped when it is nil. Set it before
+	// starting the reaper.
+	OnReapError func(error)
+	reaper      reaper
+}
+
+// Name returns "sql".
+func (b *SQLBackend) Name() string {
+	return "sql"
+}
+
+// Migrate creates the sessions table, with its id, name, user_id, data,
+// created_at, updated_at, expires_at and version columns, and its indexes.
+// Running it again is a no-op.
+func (b *SQLBackend) Migrate(ctx context.Context) error {
+	for _, stmt := range b.dialect.CreateTable(b.table) {
+		if _, err := b.db.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sqlColumns are the columns scanned by scanRecord.
+const sqlColumns = "id, name, user_id, data, created_at, updated_at, expires_at, version"
+
+// bind replaces the ? placeholders of query with those of the dialect.
+func (b *SQLBackend) bind(query string) string {
+	parts := strings.Split(query, "?")
+	var sb strings.Builder
+	for i, part := range parts {
+		if i > 0 {
+			sb.WriteString(b.dialect.Placeholder(i))
+		}
+		sb.WriteString(part)
+	}
+	return sb.String()
+}
+
+// sqlTime returns t in UTC, or NULL if t is zero, for expires_at.
+func sqlTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t.UTC()
+}
+
+// sqlString returns s, or NULL if s is empty.
+func sqlString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// scanRecord scans a row of sqlColumns.
+func scanRecord(row interface{ Scan(...interface{}) error }) (*Record, error) {
+	var rec Record
+	var userID sql.NullString
+	var expiresAt sql.NullTime
+	err := row.Scan(&rec.ID, &rec.Name, &userID, &rec.Value, &rec.Created, &rec.Updated, &expiresAt, &rec.Version)
+	if err != nil {
+		return nil, err
+	}
+
+	rec.UserID = userID.String
+	if expiresAt.Valid {
+		rec.ExpiresAt = expiresAt.Time
+	}
+	return &rec, nil
+}
+
+// Load implements Backend.
+func (b *SQLBackend) Load(ctx context.Context, id string) (*Record, error) {
+	row := b.db.QueryRowContext(ctx, b.bind(`SELECT `+sqlColumns+` FROM `+b.table+` WHERE id = ?`), id)
+	rec, err := scanRecord(row)
+	if err == sql.ErrNoRows {
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return rec, nil
+}
+
+// Save implements Backend.
+//
+// New sessions, whose rec.Version is zero, are upserted with the statement
+// of the dialect. Others are updated only if their version did not change.
+func (b *SQLBackend) Save(ctx context.Context, rec *Record) error {
+	if rec.Version != 0 {
+		res, err := b.db.ExecContext(ctx, b.bind(`UPDATE `+b.table+`
+SET name = ?, user_id = ?, data = ?, updated_at = ?, expires_at = ?, version = version + 1
+WHERE id = ? AND version = ?`),
+			rec.Name, sqlString(rec.UserID), rec.Value, rec.Updated.UTC(), sqlTime(rec.ExpiresAt), rec.ID, rec.Version)
+		if err := sqlAffected(res, err, ErrConcurrentModification); err != nil {
+			return err
+		}
+		rec.Version++
+		return nil
+	}
+
+	return b.inTx(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, b.dialect.Upsert(b.table),
+			rec.ID, rec.Name, sqlString(rec.UserID), rec.Value, rec.Created.UTC(), rec.Updated.UTC(), sqlTime(rec.ExpiresAt))
+		if err != nil {
+			return err
+		}
+
+		// The row written is locked until the transaction ends.
+		return tx.QueryRowContext(ctx, b.bind(`SELECT version FROM `+b.table+` WHERE id = ?`), rec.ID).Scan(&rec.Version)
+	})
+}
+
+// Rename implements Renamer in a single transaction.
+func (b *SQLBackend) Rename(ctx context.Context, oldID string, rec *Record) error {
+	return b.inTx(ctx, func(tx *sql.Tx) error {
+		stored := *rec
+		stored.Version = 1
+
+		var created time.Time
+		var version int64
+		err := tx.QueryRowContext(ctx, b.bind(`SELECT created_at, version FROM `+b.table+` WHERE id = ?`), oldID).Scan(&created, &version)
+		switch {
+		case err == sql.ErrNoRows:
+			if rec.Version != 0 {
+				// Deleted since it was loaded.
+				return ErrConcurrentModification
+			}
+		case err != nil:
+			return err
+		default:
+			if rec.Version != 0 && version != rec.Version {
+				return ErrConcurrentModification
+			}
+			stored.Version = version + 1
+			stored.Created = created
+
+			res, err := tx.ExecContext(ctx, b.bind(`DELETE FROM `+b.table+` WHERE id = ? AND version = ?`), oldID, version)
+			if err := sqlAffected(res, err, ErrConcurrentModification); err != nil {
+				return err
+			}
+		}
+
+		_, err = tx.ExecContext(ctx, b.bind(`INSERT INTO `+b.table+` (`+sqlColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`),
+			stored.ID, stored.Name, sqlString(stored.UserID), stored.Value, stored.Created.UTC(), stored.Updated.UTC(), sqlTime(stored.ExpiresAt), stored.Version)
+		if err != nil {
+			return err
+		}
+		rec.Version = stored.Version
+		return nil
+	})
+}
+
+// Touch implements Toucher.
+func (b *SQLBackend) Touch(ctx context.Context, id string, updated, expiresAt time.Time) error {
+	res, err := b.db.ExecContext(ctx, b.bind(`UPDATE `+b.table+` SET updated_at = ?, expires_at = ? WHERE id = ?`),
+		updated.UTC(), sqlTime(expiresAt), id)
+	return sqlAffected(res, err, ErrSessionNotFound)
+}
+
+// sqlAffected returns the error of a statement, or none if it changed a row.
+func sqlAffected(res sql.Result, err, none error) error {
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return none
+	}
+	return nil
+}
+
+// inTx runs fn in a transaction, committed if fn succeeds.
+func (b *SQLBackend) inTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := b.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Delete implements Backend.
+func (b *SQLBackend) Delete(ctx context.Context, id string) error {
+	_, err := b.db.ExecContext(ctx, b.bind(`DELETE FROM `+b.table+` WHERE id = ?`), id)
+	return err
+}
+
+// List implements Lister, filtering and paginating in the database.
+func (b *SQLBackend) List(ctx context.Context, opts ListOptions) ([]SessionInfo, string, error) {
+	where := []string{"(expires_at IS NULL OR expires_at > ?)"}
+	args := []interface{}{time.Now().UTC()}
+	filter := func(cond string, arg interface{}) {
+		where = append(where, cond)
+		args = append(args, arg)
+	}
+
+	if opts.Cursor != "" {
+		filter("id > ?", opts.Cursor)
+	}
+	if opts.Name != "" {
+		filter("name = ?", opts.Name)
+	}
+	if !opts.CreatedAfter.IsZero() {
+		filter("created_at > ?", opts.CreatedAfter.UTC())
+	}
+	if !opts.CreatedBefore.IsZero() {
+		filter("created_at < ?", opts.CreatedBefore.UTC())
+	}
+	if !opts.UpdatedAfter.IsZero() {
+		filter("updated_at > ?", opts.UpdatedAfter.UTC())
+	}
+	if !opts.UpdatedBefore.IsZero() {
+		filter("updated_at < ?", opts.UpdatedBefore.UTC())
+	}
+
+	// One more row than the page tells whether there is a next page.
+	limit := opts.limit()
+	args = append(args, limit+1)
+	infos, err := b.query(ctx, `WHERE `+strings.Join(where, " AND ")+` ORDER BY id LIMIT ?`, args...)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var next string
+	if len(infos) > limit {
+		infos = infos[:limit]
+		next = infos[limit-1].ID
+	}
+	return infos, next, nil
+}
+
+// query returns the sessions of the rows selected by the clauses following FROM.
+func (b *SQLBackend) query(ctx context.Context, clauses string, args ...interface{}) ([]SessionInfo, error) {
+	rows, err := b.db.QueryContext(ctx, b.bind(`SELECT `+sqlColumns+` FROM `+b.table+` `+clauses), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var infos []SessionInfo
+	for rows.Next() {
+		rec, err := scanRecord(rows)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, rec.info())
+	}
+	return infos, rows.Err()
+}
+
+// ListByUser implements UserIndexer using the index on user_id.
+func (b *SQLBackend) ListByUser(ctx context.Context, userID string) ([]SessionInfo, error) {
+	return b.query(ctx, `WHERE user_id = ? AND (expires_at IS NULL OR expires_at > ?) ORDER BY id`, userID, time.Now().UTC())
+}
+
+// DeleteByUser implements UserIndexer.
+func (b *SQLBackend) DeleteByUser(ctx context.Context, userID string) error {
+	_, err := b.db.ExecContext(ctx, b.bind(`DELETE FROM `+b.table+` WHERE user_id = ?`), userID)
+	return err
+}
+
+// DeleteExpired deletes the sessions whose expires_at lies in the past and
+// returns how many there were.
+func (b *SQLBackend) DeleteExpired(ctx context.Context) (int64, error) {
+	res, err := b.db.ExecContext(ctx, b.bind(`DELETE FROM `+b.table+` WHERE expires_at < ?`), time.Now().UTC())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// StartReaper starts a goroutine deleting expired sessions every interval,
+// see DeleteExpired(). Each pass is bounded by interval, the reaper is
+// stopped by Close(), which cancels a pending pass.
+func (b *SQLBackend) StartReaper(interval time.Duration) {
+	b.reaper.start(interval, func(ctx context.Context) error {
+		_, err := b.DeleteExpired(ctx)
+		return err
+	}, b.OnReapError)
+}
+
+// Close stops the reaper if it was started. The database is left open.
+func (b *SQLBackend) Close() error {
+	b.reaper.close()
+	return nil
+}
@@ -0,0 +1,309 @@
+package vagorillasessionsstores
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bh90210/vagorillasessionsstores/storetest"
+	"github.com/gorilla/sessions"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// newTestSQLStore returns a SQLStore on a new SQLite database, migrated.
+func newTestSQLStore(t *testing.T) *SQLStore {
+	dsn := filepath.Join(t.TempDir(), "sessions.db") + "?_busy_timeout=5000&_txlock=immediate&_journal_mode=WAL"
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		t.Fatal("failed to open database", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	store, err := NewSQLStore(db, SQLiteDialect{}, "", []byte("some key"))
+	if err != nil {
+		t.Fatal("failed to create store", err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	// Migrating twice is a no-op.
+	for i := 0; i < 2; i++ {
+		if err := store.Migrate(context.Background()); err != nil {
+			t.Fatal("failed to migrate", err)
+		}
+	}
+	return store
+}
+
+// Test SQLStore on SQLite against the conformance suite
+func TestSQLStoreConformance(t *testing.T) {
+	store := newTestSQLStore(t)
+
+	storetest.RunConformance(t, func(t *testing.T, keyPairs ...[]byte) sessions.Store {
+		return NewStore(store.backend, keyPairs...)
+	})
+}
+
+// Test a sql session round trip through http
+func TestSQLStore(t *testing.T) {
+	store := newTestSQLStore(t)
+
+	req, err := http.NewRequest("GET", "http://www.example.com", nil)
+	if err != nil {
+		t.Fatal("failed to create request", err)
+	}
+	session, err := store.New(req, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	session.Values["foo"] = "bar"
+
+	w := httptest.NewRecorder()
+	if err := session.Save(req, w); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	req.Header.Add("Cookie", w.Header().Get("Set-Cookie"))
+
+	session, err = store.New(req, "hello")
+	if err != nil {
+		t.Fatal("failed to load session", err)
+	}
+	if session.IsNew || session.Values["foo"] != "bar" {
+		t.Fatalf("session not loaded: IsNew %v, values %v", session.IsNew, session.Values)
+	}
+
+	session.Options.MaxAge = -1
+	if err := session.Save(req, httptest.NewRecorder()); err != nil {
+		t.Fatal("failed to delete session", err)
+	}
+	if ok, err := store.Exists(context.Background(), session.ID); err != nil || ok {
+		t.Fatalf("session not deleted: exists %v, %v", ok, err)
+	}
+}
+
+// Test listing, revoking and renaming the sql sessions of users
+func TestSQLStoreUsers(t *testing.T) {
+	store := newTestSQLStore(t)
+
+	ctx := context.Background()
+	var ids []string
+	for _, userID := range []string{"alice", "alice", "bob"} {
+		session := sessions.NewSession(store, "hello")
+		session.Options = &sessions.Options{MaxAge: 60}
+		SetUserID(session, userID)
+		if err := store.SaveByID(ctx, session); err != nil {
+			t.Fatal("failed to save session", err)
+		}
+		ids = append(ids, session.ID)
+	}
+
+	infos, next, err := store.List(ctx, ListOptions{Limit: 2})
+	if err != nil {
+		t.Fatal("failed to list sessions", err)
+	}
+	if len(infos) != 2 || next == "" {
+		t.Fatalf("bad first page: %d sessions, next %q", len(infos), next)
+	}
+	infos, next, err = store.List(ctx, ListOptions{Limit: 2, Cursor: next})
+	if err != nil {
+		t.Fatal("failed to list sessions", err)
+	}
+	if len(infos) != 1 || next != "" {
+		t.Fatalf("bad last page: %d sessions, next %q", len(infos), next)
+	}
+	infos, _, err = store.List(ctx, ListOptions{Name: "other"})
+	if err != nil || len(infos) != 0 {
+		t.Fatalf("expected no session named other, got %+v, %v", infos, err)
+	}
+
+	infos, err = store.ListSessionsForUser(ctx, "alice")
+	if err != nil {
+		t.Fatal("failed to list sessions", err)
+	}
+	if len(infos) != 2 || infos[0].UserID != "alice" {
+		t.Fatalf("expected 2 sessions of alice, got %+v", infos)
+	}
+
+	req, err := http.NewRequest("GET", "http://www.example.com", nil)
+	if err != nil {
+		t.Fatal("failed to create request", err)
+	}
+	session, err := store.LoadByID(ctx, "hello", ids[0])
+	if err != nil {
+		t.Fatal("failed to load session", err)
+	}
+	if err := store.RegenerateID(req, httptest.NewRecorder(), session); err != nil {
+		t.Fatal("failed to regenerate session ID", err)
+	}
+	if ok, _ := store.Exists(ctx, ids[0]); ok {
+		t.Fatal("old session not deleted")
+	}
+	if _, err := store.LoadByID(ctx, "hello", session.ID); err != nil {
+		t.Fatal("failed to load renamed session", err)
+	}
+
+	if err := store.RevokeAllForUser(ctx, "alice"); err != nil {
+		t.Fatal("failed to revoke sessions", err)
+	}
+	for i, id := range []string{session.ID, ids[1], ids[2]} {
+		ok, err := store.Exists(ctx, id)
+		if err != nil {
+			t.Fatal("failed to check session", err)
+		}
+		if ok != (i == 2) {
+			t.Fatalf("session %d: exists %v", i, ok)
+		}
+	}
+}
+
+// Test that a sql session saved concurrently since it was loaded is not overwritten
+func TestSQLStoreConcurrentModification(t *testing.T) {
+	store := newTestSQLStore(t)
+
+	ctx := context.Background()
+	session := sessions.NewSession(store, "hello")
+	session.Options = &sessions.Options{MaxAge: 60}
+	if err := store.SaveByID(ctx, session); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+
+	first, err := store.LoadByID(ctx, "hello", session.ID)
+	if err != nil {
+		t.Fatal("failed to load session", err)
+	}
+	second, err := store.LoadByID(ctx, "hello", session.ID)
+	if err != nil {
+		t.Fatal("failed to load session", err)
+	}
+
+	first.Values["a"] = "1"
+	if err := store.SaveByID(ctx, first); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	second.Values["b"] = "2"
+	if err := store.SaveByID(ctx, second); !errors.Is(err, ErrConcurrentModification) {
+		t.Fatalf("expected ErrConcurrentModification, got %v", err)
+	}
+}
+
+// Test touching sql sessions and deleting the expired ones
+func TestSQLStoreTouchDeleteExpired(t *testing.T) {
+	store := newTestSQLStore(t)
+
+	ctx := context.Background()
+	var ids []string
+	for _, maxAge := range []int{1, 1, 60} {
+		session := sessions.NewSession(store, "hello")
+		session.Options = &sessions.Options{MaxAge: maxAge}
+		if err := store.SaveByID(ctx, session); err != nil {
+			t.Fatal("failed to save session", err)
+		}
+		ids = append(ids, session.ID)
+	}
+
+	touched, err := store.LoadByID(ctx, "hello", ids[1])
+	if err != nil {
+		t.Fatal("failed to load session", err)
+	}
+	touched.Options.MaxAge = 60
+	if err := store.Touch(ctx, touched); err != nil {
+		t.Fatal("failed to touch session", err)
+	}
+	missing := sessions.NewSession(store, "hello")
+	missing.ID = "missing"
+	if err := store.Touch(ctx, missing); err != ErrSessionNotFound {
+		t.Fatalf("expected ErrSessionNotFound, got %v", err)
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+	n, err := store.DeleteExpired(ctx)
+	if err != nil {
+		t.Fatal("failed to delete expired sessions", err)
+	}
+	if n != 1 {
+		t.Fatalf("expected 1 expired session, got %d", n)
+	}
+	for i, id := range ids {
+		var count int
+		if err := store.backend.db.QueryRow(`SELECT COUNT(*) FROM sessions WHERE id = ?`, id).Scan(&count); err != nil {
+			t.Fatal("failed to count sessions", err)
+		}
+		if (count == 1) != (i > 0) {
+			t.Fatalf("session %d: %d rows", i, count)
+		}
+	}
+}
+
+// Test that the reaper deletes expired sessions and reports failed passes
+func TestSQLStoreReaper(t *testing.T) {
+	store := newTestSQLStore(t)
+
+	ctx := context.Background()
+	session := sessions.NewSession(store, "hello")
+	session.Options = &sessions.Options{MaxAge: 1}
+	if err := store.SaveByID(ctx, session); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+
+	errs := make(chan error, 1)
+	store.SetOnReapError(func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	})
+	store.StartReaper(100 * time.Millisecond)
+	// Starting twice is a no-op.
+	store.StartReaper(100 * time.Millisecond)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var count int
+		if err := store.backend.db.QueryRow(`SELECT COUNT(*) FROM sessions`).Scan(&count); err != nil {
+			t.Fatal("failed to count sessions", err)
+		}
+		if count == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expired session was not reaped")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if _, err := store.backend.db.Exec(`DROP TABLE sessions`); err != nil {
+		t.Fatal("failed to drop table", err)
+	}
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Fatal("expected a reaper error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("reaper error was not reported")
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := store.Close(); err != nil {
+			t.Fatal("failed to close store", err)
+		}
+	}
+}
+
+// Test that statements are written with the placeholders of each dialect
+func TestSQLDialectBind(t *testing.T) {
+	query := `SELECT id FROM sessions WHERE name = ? AND user_id = ?`
+	for dialect, expected := range map[Dialect]string{
+		PostgresDialect{}: `SELECT id FROM sessions WHERE name = $1 AND user_id = $2`,
+		MySQLDialect{}:    `SELECT id FROM sessions WHERE name = ? AND user_id = ?`,
+		SQLiteDialect{}:   `SELECT id FROM sessions WHERE name = ?1 AND user_id = ?2`,
+	} {
+		if got := NewSQLBackend(nil, dialect, "").bind(query); got != expected {
+			t.Fatalf("%T: expected %q, got %q", dialect, expected, got)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package vagorillasessionsstores
+
+import "strconv"
+
+// Dialect adapts the statements of a SQLBackend to a database. Statements
+// take their parameters in the order documented for each method.
+type Dialect interface {
+	// Placeholder returns the placeholder of the nth parameter of a statement,
+	// counting from 1.
+	Placeholder(n int) string
+	// CreateTable returns the statements creating table and its indexes on
+	// expires_at and user_id, doing nothing for those that exist.
+	CreateTable(table string) []string
+	// Upsert returns a statement inserting a session with version 1 or, if
+	// its id exists, replacing everything but created_at and incrementing
+	// version. Parameters: id, name, user_id, data, created_at, updated_at,
+	// expires_at.
+	Upsert(table string) string
+}
+
+// PostgresDialect is the Dialect of PostgreSQL 9.5 and later.
+type PostgresDialect struct{}
+
+// Placeholder implements Dialect.
+func (PostgresDialect) Placeholder(n int) string {
+	return "$" + strconv.Itoa(n)
+}
+
+// CreateTable implements Dialect.
+func (PostgresDialect) CreateTable(table string) []string {
+	return []string{
+		`CREATE TABLE IF NOT EXISTS ` + table + ` (
+	id TEXT PRIMARY KEY,
+	name TEXT NOT NULL,
+	user_id TEXT,
+	data BYTEA,
+	created_at TIMESTAMPTZ NOT NULL,
+	updated_at TIMESTAMPTZ NOT NULL,
+	expires_at TIMESTAMPTZ,
+	version BIGINT NOT NULL
+)`,
+		`CREATE INDEX IF NOT EXISTS ` + table + `_expires_at ON ` + table + ` (expires_at)`,
+		`CREATE INDEX IF NOT EXISTS ` + table + `_user_id ON ` + table + ` (user_id)`,
+	}
+}
+
+// Upsert implements Dialect.
+func (PostgresDialect) Upsert(table string) string {
+	return `INSERT INTO ` + table + ` (id, name, user_id, data, created_at, updated_at, expires_at, version)
+VALUES ($1, $2, $3, $4, $5, $6, $7, 1)
+ON CONFLICT (id) DO UPDATE SET name = EXCLUDED.name, user_id = EXCLUDED.user_id, data = EXCLUDED.data,
+	updated_at = EXCLUDED.updated_at, expires_at = EXCLUDED.expires_at, version = ` + table + `.version + 1`
+}
+
+// MySQLDialect is the Dialect of MySQL 5.6.4 and MariaDB 10.1 and later.
+// Open the database with the parseTime=true DSN parameter so that times
+// can be scanned.
+type MySQLDialect struct{}
+
+// Placeholder implements Dialect.
+func (MySQLDialect) Placeholder(n int) string {
+	return "?"
+}
+
+// CreateTable implements Dialect. MySQL cannot create an index only if it
+// does not exist, they are declared with the table.
+func (MySQLDialect) CreateTable(table string) []string {
+	return []string{
+		`CREATE TABLE IF NOT EXISTS ` + table + ` (
+	id VARCHAR(255) NOT NULL PRIMARY KEY,
+	name VARCHAR(255) NOT NULL,
+	user_id VARCHAR(255),
+	data LONGBLOB,
+	created_at DATETIME(6) NOT NULL,
+	updated_at DATETIME(6) NOT NULL,
+	expires_at DATETIME(6),
+	version BIGINT NOT NULL,
+	INDEX ` + table + `_expires_at (expires_at),
+	INDEX ` + table + `_user_id (user_id)
+)`,
+	}
+}
+
+// Upsert implements Dialect.
+func (MySQLDialect) Upsert(table string) string {
+	return `INSERT INTO ` + table + ` (id, name, user_id, data, created_at, updated_at, expires_at, version)
+VALUES (?, ?, ?, ?, ?, ?, ?, 1)
+ON DUPLICATE KEY UPDATE name = VALUES(name), user_id = VALUES(user_id), data = VALUES(data),
+	updated_at = VALUES(updated_at), expires_at = VALUES(expires_at), version = version + 1`
+}
+
+// SQLiteDialect is the Dialect of SQLite 3.24 and later.
+type SQLiteDialect struct{}
+
+// Placeholder implements Dialect.
+func (SQLiteDialect) Placeholder(n int) string {
+	return "?" + strconv.Itoa(n)
+}
+
+// CreateTable implements Dialect.
+func (SQLiteDialect) CreateTable(table string) []string {
+	return []string{
+		`CREATE TABLE IF NOT EXISTS ` + table + ` (
+	id TEXT PRIMARY KEY,
+	name TEXT NOT NULL,
+	user_id TEXT,
+	data BLOB,
+	created_at TIMESTAMP NOT NULL,
+	updated_at TIMESTAMP NOT NULL,
+	expires_at TIMESTAMP,
+	version INTEGER NOT NULL
+)`,
+		`CREATE INDEX IF NOT EXISTS ` + table + `_expires_at ON ` + table + ` (expires_at)`,
+		`CREATE INDEX IF NOT EXISTS ` + table + `_user_id ON ` + table + ` (user_id)`,
+	}
+}
+
+// Upsert implements Dialect.
+func (SQLiteDialect) Upsert(table string) string {
+	return `INSERT INTO ` + table + ` (id, name, user_id, data, created_at, updated_at, expires_at, version)
+VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7, 1)
+ON CONFLICT (id) DO UPDATE SET name = excluded.name, user_id = excluded.user_id, data = excluded.data,
+	updated_at = excluded.updated_at, expires_at = excluded.expires_at, version = ` + table + `.version + 1`
+}
@@ -0,0 +1,454 @@
+// Package vagorillasessionsstores is a Gorilla sessions.Store implementation for BadgerDB, MongoDB, Dgraph, Redis and SQL databases
+package vagorillasessionsstores
+
+import (
+	"context"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// Backend persists sessions for a Store.
+//
+// Implementations only deal with storage. Cookies, encoding of session values
+// and expiry policy are handled by Store, so a new back-end only has to
+// implement these three methods.
+type Backend interface {
+	// Load returns the record stored under id.
+	// It returns ErrSessionNotFound if the record is missing. Expired records
+	// may be returned, or reported with ErrSessionNotFound or ErrSessionExpired.
+	Load(ctx context.Context, id string) (*Record, error)
+	// Save creates or replaces the record stored under rec.ID.
+	// The record should be removed, or at least not loaded, after rec.ExpiresAt.
+	Save(ctx context.Context, rec *Record) error
+	// Delete removes the record stored under id. Deleting a missing record is not an error.
+	Delete(ctx context.Context, id string) error
+}
+
+// Record is a session as persisted by a Backend.
+type Record struct {
+	ID string
+	// Name is the name the session was saved under.
+	Name string
+	// UserID is the user owning the session, see SetUserID().
+	UserID string
+	Value  []byte
+	// Values holds the session values unencoded instead of Value, for
+	// back-ends storing them natively, see ValueStorer.
+	Values map[interface{}]interface{}
+	// Created is the time the record was first saved. Back-ends keep the
+	// stored value when Save replaces an existing record.
+	Created   time.Time
+	Updated   time.Time
+	ExpiresAt time.Time
+	// Version counts the saves of the record. Save only replaces a record
+	// whose version is still rec.Version, unless it is zero, and returns
+	// ErrConcurrentModification otherwise. It sets rec.Version to the
+	// version written.
+	Version int64
+}
+
+// NewStore returns a new Store persisting sessions in backend.
+//
+// Keys are defined in pairs to allow key rotation, but the common case is
+// to set a single authentication key and optionally an encryption key.
+//
+// The first key in a pair is used for authentication and the second for
+// encryption. The encryption key can be set to nil or omitted in the last
+// pair, but the authentication key is required in all pairs.
+//
+// It is recommended to use an authentication key with 32 or 64 bytes.
+// The encryption key, if set, must be either 16, 24, or 32 bytes to select
+// AES-128, AES-192, or AES-256 modes.
+func NewStore(backend Backend, keyPairs ...[]byte) *Store {
+	store := &Store{
+		Codecs: securecookie.CodecsFromPairs(keyPairs...),
+		Options: &sessions.Options{
+			Path:   "/",
+			MaxAge: 86400 * 30,
+		},
+		Timeout: 5 * time.Second,
+		backend: backend,
+	}
+
+	store.MaxAge(store.Options.MaxAge)
+	return store
+}
+
+// Store is a sessions.Store keeping session values server-side in a Backend.
+// Only the session ID is sent to the client in an authenticated cookie.
+type Store struct {
+	Codecs  []securecookie.Codec
+	Options *sessions.Options
+	// Timeout bounds every back-end operation on top of the caller's context.
+	// Zero means no timeout other than the caller's.
+	Timeout time.Duration
+	// IdleTimeout expires sessions not saved or touched for this long, see
+	// Touch(). AbsoluteTimeout expires sessions this long after their
+	// creation, however active. Zero disables them.
+	IdleTimeout     time.Duration
+	AbsoluteTimeout time.Duration
+	// SkipUnchanged skips writing loaded sessions whose values did not
+	// change. Their expiry is then left as is, unless TouchUnchanged is set
+	// to refresh it with Touch().
+	SkipUnchanged  bool
+	TouchUnchanged bool
+	// Merge resolves a save conflict with a concurrent request, see MergeFunc.
+	// When nil, Save returns ErrConcurrentModification.
+	Merge MergeFunc
+	// Serializer encodes session values at rest. When nil, values are
+	// encoded with Codecs like a cookie, the format of earlier versions.
+	Serializer Serializer
+	// ValueCodecs optionally authenticate and encrypt the values encoded by
+	// Serializer, see NewValueCodecs(). They are not used without a Serializer.
+	ValueCodecs []securecookie.Codec
+	// Observer is notified of every operation, e.g. to export metrics.
+	// See NewExpvarObserver() and the promobserver package.
+	Observer Observer
+	// Tracer starts a span around every back-end operation, see Tracer.
+	Tracer  Tracer
+	backend Backend
+}
+
+// Get returns a session for the given name after adding it to the registry.
+//
+// It returns a new session if the sessions doesn't exist. Access IsNew on
+// the session to check if it is an existing session or a new one.
+//
+// It returns a new session and an error if the session exists but could
+// not be loaded: ErrInvalidCookie for a cookie that does not decode,
+// ErrSessionExpired for an expired session and a *BackendError when the
+// database failed.
+func (s *Store) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New returns a session for the given name without adding it to the registry.
+//
+// The difference between New() and Get() is that calling New() twice will
+// decode the session data twice, while Get() registers and reuses the same
+// decoded session after the first call.
+func (s *Store) New(r *http.Request, name string) (*sessions.Session, error) {
+	var value string
+	if c, errCookie := r.Cookie(name); errCookie == nil {
+		value = c.Value
+	}
+	return s.GetContext(r.Context(), name, value)
+}
+
+// Save adds a single session to the response.
+//
+// If the Options.MaxAge of the session is <= 0 then the session file will be
+// deleted from the store path. With this process it enforces the properly
+// session cookie handling so no need to trust in the cookie management in the
+// web browser.
+func (s *Store) Save(r *http.Request, w http.ResponseWriter,
+	session *sessions.Session) error {
+	encoded, err := s.SaveContext(r.Context(), session)
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+// GetContext returns the session for the given name and encoded cookie value,
+// for callers outside of net/http such as websocket or RPC handlers.
+//
+// Database work is bound to ctx. No registry is involved, every call loads
+// the session again. An empty value returns a new session.
+func (s *Store) GetContext(ctx context.Context, name, value string) (*sessions.Session, error) {
+	start := time.Now()
+	session := s.newSession(name)
+	if value == "" {
+		s.observe("new", start, nil)
+		return session, nil
+	}
+
+	err := securecookie.DecodeMulti(name, value, &session.ID,
+		s.Codecs...)
+	if err != nil {
+		err = fmt.Errorf("%w: %v", ErrInvalidCookie, err)
+		s.observe("load", start, err)
+		s.observe("new", start, nil)
+		return session, err
+	}
+
+	err = s.load(ctx, session)
+	switch {
+	case err == nil:
+		session.IsNew = false
+	case errors.Is(err, ErrSessionNotFound):
+		// A missing record starts over as a new session.
+		err = nil
+	}
+	if session.IsNew {
+		// Never hand out the ID of a session that could not be loaded.
+		session.ID = ""
+		s.observe("new", start, nil)
+	}
+	return session, err
+}
+
+// SaveContext persists session and returns the encoded cookie value the
+// client must send back, for callers outside of net/http.
+//
+// If the Options.MaxAge of the session is <= 0 the session is deleted and an
+// empty value is returned. Database work is bound to ctx.
+func (s *Store) SaveContext(ctx context.Context, session *sessions.Session) (string, error) {
+	// Delete if max-age is <= 0
+	if session.Options.MaxAge <= 0 {
+		// A session without an ID was never saved, there is nothing to delete.
+		if session.ID == "" {
+			return "", nil
+		}
+		if err := s.erase(ctx, session.Name(), session.ID); err != nil {
+			return "", err
+		}
+		return "", nil
+	}
+
+	if session.ID == "" {
+		session.ID = newSessionID()
+	}
+
+	if err := s.save(ctx, session); err != nil {
+		return "", err
+	}
+
+	return securecookie.EncodeMulti(session.Name(), session.ID,
+		s.Codecs...)
+}
+
+// LoadByID returns the session stored under id without an http.Request,
+// e.g. for background workers or admin tools knowing only the session ID.
+//
+// Unlike New() it returns ErrSessionNotFound when there is no such session
+// and ErrSessionExpired when the session has expired. An empty id is never
+// found.
+func (s *Store) LoadByID(ctx context.Context, name, id string) (*sessions.Session, error) {
+	if id == "" {
+		return nil, ErrSessionNotFound
+	}
+
+	session := s.newSession(name)
+	session.ID = id
+	if err := s.load(ctx, session); err != nil {
+		return nil, err
+	}
+
+	session.IsNew = false
+	return session, nil
+}
+
+// SaveByID persists session under its ID without writing a cookie.
+// A session without an ID is given a new one, a session with
+// Options.MaxAge <= 0 is deleted.
+func (s *Store) SaveByID(ctx context.Context, session *sessions.Session) error {
+	_, err := s.SaveContext(ctx, session)
+	return err
+}
+
+// DeleteByID deletes the session stored under id, e.g. to revoke it.
+// The client's cookie is left as is, its next request gets a new session.
+// It returns ErrSessionNotFound for an empty id.
+func (s *Store) DeleteByID(ctx context.Context, id string) error {
+	if id == "" {
+		return ErrSessionNotFound
+	}
+	return s.erase(ctx, "", id)
+}
+
+// Exists reports whether a live session is stored under id.
+func (s *Store) Exists(ctx context.Context, id string) (bool, error) {
+	if id == "" {
+		return false, nil
+	}
+
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	rec, err := s.backend.Load(ctx, id)
+	if errors.Is(err, ErrSessionNotFound) || errors.Is(err, ErrSessionExpired) {
+		return false, nil
+	}
+	if err != nil {
+		return false, backendError(s.backend, "load", err)
+	}
+
+	now := time.Now()
+	if !rec.ExpiresAt.IsZero() && !rec.ExpiresAt.After(now) {
+		return false, nil
+	}
+	return s.checkTimeouts(rec, now) == nil, nil
+}
+
+// MaxAge sets the maximum age for the store and the underlying cookie
+// implementation. Individual sessions can be deleted by setting Options.MaxAge
+// = -1 for that session.
+func (s *Store) MaxAge(age int) {
+	s.Options.MaxAge = age
+
+	// Set the maxAge for each securecookie instance.
+	for _, codec := range s.Codecs {
+		if sc, ok := codec.(*securecookie.SecureCookie); ok {
+			sc.MaxAge(age)
+		}
+	}
+}
+
+// newSession returns a new session using a copy of the store's options.
+func (s *Store) newSession(name string) *sessions.Session {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+	return session
+}
+
+// withTimeout derives the context of a single back-end operation from ctx.
+func (s *Store) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.Timeout > 0 {
+		return context.WithTimeout(ctx, s.Timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// metaKey is the type of session value keys holding data the store keeps
+// outside of the encoded values, such as the owning user.
+type metaKey string
+
+// storedValues returns the session values to encode, without the store's metadata.
+func storedValues(values map[interface{}]interface{}) map[interface{}]interface{} {
+	stored := make(map[interface{}]interface{}, len(values))
+	for k, v := range values {
+		if _, ok := k.(metaKey); !ok {
+			stored[k] = v
+		}
+	}
+	return stored
+}
+
+// newSessionID returns a new random session ID.
+func newSessionID() string {
+	return strings.TrimRight(
+		base32.StdEncoding.EncodeToString(
+			securecookie.GenerateRandomKey(32)), "=")
+}
+
+// record encodes session into the Record to persist.
+func (s *Store) record(session *sessions.Session) (*Record, error) {
+	now := time.Now()
+	session.Values[createdKey] = created(session, now)
+	rec := &Record{
+		ID:        session.ID,
+		Name:      session.Name(),
+		UserID:    UserID(session),
+		Created:   created(session, now),
+		Updated:   now,
+		ExpiresAt: s.expiresAt(session, now),
+		Version:   version(session),
+	}
+
+	if vs, ok := s.backend.(ValueStorer); ok && vs.StoresValues() {
+		rec.Values = storedValues(session.Values)
+		return rec, nil
+	}
+
+	value, err := s.encode(session)
+	if err != nil {
+		return nil, err
+	}
+	rec.Value = value
+	return rec, nil
+}
+
+func (s *Store) save(ctx context.Context, session *sessions.Session) (err error) {
+	ctx, done := s.start(ctx, "save", session.Name())
+	defer func() { done(err) }()
+
+	if skip, err := s.skipSave(ctx, session); skip || err != nil {
+		return err
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := s.write(ctx, session)
+		if !errors.Is(err, ErrConcurrentModification) || s.Merge == nil || attempt == maxMergeAttempts {
+			return err
+		}
+		if err := s.merge(ctx, session); err != nil {
+			return err
+		}
+	}
+}
+
+// write persists session, failing if it was saved concurrently since it was loaded.
+func (s *Store) write(ctx context.Context, session *sessions.Session) error {
+	rec, err := s.record(session)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	if err := s.backend.Save(ctx, rec); err != nil {
+		return backendError(s.backend, "save", err)
+	}
+
+	setVersion(session, rec.Version)
+	s.markClean(session)
+	return nil
+}
+
+func (s *Store) load(ctx context.Context, session *sessions.Session) (err error) {
+	ctx, done := s.start(ctx, "load", session.Name())
+	defer func() { done(err) }()
+
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	rec, err := s.backend.Load(ctx, session.ID)
+	if err != nil {
+		return backendError(s.backend, "load", err)
+	}
+
+	// Back-ends may keep expired records around for a while before removing them.
+	now := time.Now()
+	if !rec.ExpiresAt.IsZero() && rec.ExpiresAt.Before(now) {
+		return ErrSessionExpired
+	}
+	if err := s.checkTimeouts(rec, now); err != nil {
+		return err
+	}
+
+	if rec.Values != nil {
+		for k, v := range rec.Values {
+			session.Values[k] = v
+		}
+	} else if err := s.decode(session, rec.Value); err != nil {
+		return err
+	}
+
+	SetUserID(session, rec.UserID)
+	if !rec.Created.IsZero() {
+		session.Values[createdKey] = rec.Created
+	}
+	setVersion(session, rec.Version)
+	s.markClean(session)
+	return nil
+}
+
+// erase deletes the session called name, which may be unknown, stored under id.
+func (s *Store) erase(ctx context.Context, name, id string) (err error) {
+	ctx, done := s.start(ctx, "delete", name)
+	defer func() { done(err) }()
+
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	return backendError(s.backend, "delete", s.backend.Delete(ctx, id))
+}
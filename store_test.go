@@ -0,0 +1,782 @@
+package vagorillasessionsstores
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// memoryBackend is a Backend keeping records in a map, used to test Store on its own.
+type memoryBackend struct {
+	mu      sync.Mutex
+	records map[string]Record
+}
+
+func newMemoryBackend() *memoryBackend {
+	return &memoryBackend{records: make(map[string]Record)}
+}
+
+func (b *memoryBackend) Load(ctx context.Context, id string) (*Record, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	rec, ok := b.records[id]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	return &rec, nil
+}
+
+func (b *memoryBackend) Save(ctx context.Context, rec *Record) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.records[rec.ID] = *rec
+	return nil
+}
+
+func (b *memoryBackend) Delete(ctx context.Context, id string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.records, id)
+	return nil
+}
+
+// Test a session round trip through a Store
+func TestStore(t *testing.T) {
+	backend := newMemoryBackend()
+	store := NewStore(backend, []byte("some key"))
+
+	req, err := http.NewRequest("GET", "http://www.example.com", nil)
+	if err != nil {
+		t.Fatal("failed to create request", err)
+	}
+	w := httptest.NewRecorder()
+
+	session, err := store.New(req, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	if !session.IsNew {
+		t.Fatal("session should be new")
+	}
+
+	session.Values["foo"] = "bar"
+	err = session.Save(req, w)
+	if err != nil {
+		t.Fatal("failed to save session", err)
+	}
+
+	rec, err := backend.Load(context.Background(), session.ID)
+	if err != nil {
+		t.Fatal("session not saved to the backend", err)
+	}
+	if rec.ExpiresAt.Before(time.Now().Add(29 * 24 * time.Hour)) {
+		t.Fatalf("bad expiry: %v", rec.ExpiresAt)
+	}
+
+	req, err = http.NewRequest("GET", "http://www.example.com", nil)
+	if err != nil {
+		t.Fatal("failed to create request", err)
+	}
+	req.Header.Add("Cookie", w.Header().Get("Set-Cookie"))
+
+	session, err = store.New(req, "hello")
+	if err != nil {
+		t.Fatal("failed to load session", err)
+	}
+	if session.IsNew || session.Values["foo"] != "bar" {
+		t.Fatalf("session not loaded: IsNew %v, values %v", session.IsNew, session.Values)
+	}
+
+	session.Options.MaxAge = -1
+	err = session.Save(req, httptest.NewRecorder())
+	if err != nil {
+		t.Fatal("failed to delete session", err)
+	}
+
+	if _, err := backend.Load(context.Background(), session.ID); err != ErrSessionNotFound {
+		t.Fatalf("session not deleted: %v", err)
+	}
+}
+
+// Test that records past their expiry are not loaded even if the backend returns them
+func TestStoreExpiredRecord(t *testing.T) {
+	backend := newMemoryBackend()
+	store := NewStore(backend, []byte("some key"))
+
+	req, err := http.NewRequest("GET", "http://www.example.com", nil)
+	if err != nil {
+		t.Fatal("failed to create request", err)
+	}
+	w := httptest.NewRecorder()
+
+	session, err := store.New(req, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+
+	err = session.Save(req, w)
+	if err != nil {
+		t.Fatal("failed to save session", err)
+	}
+
+	rec := backend.records[session.ID]
+	rec.ExpiresAt = time.Now().Add(-time.Second)
+	backend.records[session.ID] = rec
+
+	req.Header.Add("Cookie", w.Header().Get("Set-Cookie"))
+	session, err = store.New(req, "hello")
+	if !errors.Is(err, ErrSessionExpired) {
+		t.Fatalf("expected ErrSessionExpired, got %v", err)
+	}
+	if !session.IsNew || session.ID != "" {
+		t.Fatal("expired session should be new")
+	}
+}
+
+// failingBackend is a Backend whose database is always down.
+type failingBackend struct{}
+
+var errDatabaseDown = errors.New("database down")
+
+func (failingBackend) Load(ctx context.Context, id string) (*Record, error) {
+	return nil, errDatabaseDown
+}
+
+func (failingBackend) Save(ctx context.Context, rec *Record) error {
+	return errDatabaseDown
+}
+
+func (failingBackend) Delete(ctx context.Context, id string) error {
+	return errDatabaseDown
+}
+
+// Test the errors returned for tampered cookies, missing records and back-end failures
+func TestStoreErrors(t *testing.T) {
+	store := NewStore(newMemoryBackend(), []byte("some key"))
+
+	req, err := http.NewRequest("GET", "http://www.example.com", nil)
+	if err != nil {
+		t.Fatal("failed to create request", err)
+	}
+	req.AddCookie(&http.Cookie{Name: "hello", Value: "forged"})
+
+	session, err := store.New(req, "hello")
+	if !errors.Is(err, ErrInvalidCookie) {
+		t.Fatalf("expected ErrInvalidCookie, got %v", err)
+	}
+	if !session.IsNew {
+		t.Fatal("session with an invalid cookie should be new")
+	}
+
+	encoded, err := securecookie.EncodeMulti("hello", "missing", store.Codecs...)
+	if err != nil {
+		t.Fatal("failed to encode cookie", err)
+	}
+	req, err = http.NewRequest("GET", "http://www.example.com", nil)
+	if err != nil {
+		t.Fatal("failed to create request", err)
+	}
+	req.AddCookie(&http.Cookie{Name: "hello", Value: encoded})
+
+	session, err = store.New(req, "hello")
+	if err != nil {
+		t.Fatal("missing record should not return an error", err)
+	}
+	if !session.IsNew {
+		t.Fatal("session with a missing record should be new")
+	}
+
+	store = NewStore(failingBackend{}, []byte("some key"))
+	session, err = store.New(req, "hello")
+	var be *BackendError
+	if !errors.As(err, &be) || !errors.Is(err, errDatabaseDown) || be.Op != "load" {
+		t.Fatalf("expected a load BackendError, got %v", err)
+	}
+	if !session.IsNew {
+		t.Fatal("session that failed to load should be new")
+	}
+
+	err = session.Save(req, httptest.NewRecorder())
+	if !errors.As(err, &be) || be.Op != "save" {
+		t.Fatalf("expected a save BackendError, got %v", err)
+	}
+}
+
+// blockingBackend is a memoryBackend whose database hangs until the
+// context of the call is done.
+type blockingBackend struct {
+	*memoryBackend
+}
+
+func (blockingBackend) Load(ctx context.Context, id string) (*Record, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (blockingBackend) Save(ctx context.Context, rec *Record) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+// TryLock hangs like Load and Save, then fails with an error that hides
+// the context error, as gRPC statuses do.
+func (blockingBackend) TryLock(ctx context.Context, id, token string, ttl time.Duration) (bool, error) {
+	<-ctx.Done()
+	return false, fmt.Errorf("rpc error: %v", ctx.Err())
+}
+
+func (blockingBackend) Unlock(ctx context.Context, id, token string) error {
+	return nil
+}
+
+// Test that back-end calls are cut short by the store timeout and by the request context
+func TestStoreTimeout(t *testing.T) {
+	store := NewStore(blockingBackend{newMemoryBackend()}, []byte("some key"))
+	store.Timeout = 50 * time.Millisecond
+
+	encoded, err := securecookie.EncodeMulti("hello", "someid", store.Codecs...)
+	if err != nil {
+		t.Fatal("failed to encode cookie", err)
+	}
+	_, err = store.GetContext(context.Background(), "hello", encoded)
+	var be *BackendError
+	if !errors.As(err, &be) || be.Op != "load" || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected a load BackendError wrapping context.DeadlineExceeded, got %v", err)
+	}
+
+	session := sessions.NewSession(store, "hello")
+	session.Options = &sessions.Options{MaxAge: 60}
+	if _, err := store.SaveContext(context.Background(), session); !errors.As(err, &be) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected a save BackendError wrapping context.DeadlineExceeded, got %v", err)
+	}
+
+	// Without a store timeout, the request context still bounds the call.
+	store.Timeout = 0
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://www.example.com", nil)
+	if err != nil {
+		t.Fatal("failed to create request", err)
+	}
+	req.AddCookie(&http.Cookie{Name: "hello", Value: encoded})
+	cancel()
+	if _, err := store.New(req, "hello"); !errors.As(err, &be) || !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected a load BackendError wrapping context.Canceled, got %v", err)
+	}
+}
+
+// Test that Lock returns the context error even when the back-end hides it
+func TestStoreLockContext(t *testing.T) {
+	store := NewStore(blockingBackend{newMemoryBackend()}, []byte("some key"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := store.Lock(ctx, "someid", time.Second); err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
+// Test a session round trip through GetContext and SaveContext, without net/http
+func TestStoreContext(t *testing.T) {
+	store := NewStore(newMemoryBackend(), []byte("some key"))
+	ctx := context.Background()
+
+	session, err := store.GetContext(ctx, "hello", "")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	if !session.IsNew {
+		t.Fatal("session should be new")
+	}
+
+	session.Values["foo"] = "bar"
+	encoded, err := store.SaveContext(ctx, session)
+	if err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	if encoded == "" {
+		t.Fatal("no cookie value returned")
+	}
+
+	loaded, err := store.GetContext(ctx, "hello", encoded)
+	if err != nil {
+		t.Fatal("failed to load session", err)
+	}
+	if loaded.IsNew || loaded.ID != session.ID || loaded.Values["foo"] != "bar" {
+		t.Fatalf("session not loaded: IsNew %v, values %v", loaded.IsNew, loaded.Values)
+	}
+
+	loaded.Options.MaxAge = -1
+	if encoded, err := store.SaveContext(ctx, loaded); err != nil || encoded != "" {
+		t.Fatalf("failed to delete session: %q %v", encoded, err)
+	}
+	if session, err := store.GetContext(ctx, "hello", encoded); err != nil || !session.IsNew {
+		t.Fatalf("deleted session should be new: %v", err)
+	}
+}
+
+// Test manipulating sessions by ID without a request
+func TestStoreByID(t *testing.T) {
+	store := NewStore(newMemoryBackend(), []byte("some key"))
+	ctx := context.Background()
+
+	if _, err := store.LoadByID(ctx, "hello", "missing"); err != ErrSessionNotFound {
+		t.Fatalf("expected ErrSessionNotFound, got %v", err)
+	}
+	if _, err := store.LoadByID(ctx, "hello", ""); err != ErrSessionNotFound {
+		t.Fatalf("expected ErrSessionNotFound for an empty ID, got %v", err)
+	}
+	if err := store.DeleteByID(ctx, ""); err != ErrSessionNotFound {
+		t.Fatalf("expected ErrSessionNotFound for an empty ID, got %v", err)
+	}
+	if ok, err := store.Exists(ctx, ""); err != nil || ok {
+		t.Fatalf("empty ID should not exist: %v %v", ok, err)
+	}
+
+	session := sessions.NewSession(store, "hello")
+	session.Options = &sessions.Options{MaxAge: 60}
+	session.Values["foo"] = "bar"
+	if err := store.SaveByID(ctx, session); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	if session.ID == "" {
+		t.Fatal("session should have been given an ID")
+	}
+
+	ok, err := store.Exists(ctx, session.ID)
+	if err != nil || !ok {
+		t.Fatalf("session should exist: %v %v", ok, err)
+	}
+
+	loaded, err := store.LoadByID(ctx, "hello", session.ID)
+	if err != nil {
+		t.Fatal("failed to load session", err)
+	}
+	if loaded.IsNew || loaded.Values["foo"] != "bar" {
+		t.Fatalf("session not loaded: IsNew %v, values %v", loaded.IsNew, loaded.Values)
+	}
+
+	if err := store.DeleteByID(ctx, session.ID); err != nil {
+		t.Fatal("failed to delete session", err)
+	}
+
+	ok, err = store.Exists(ctx, session.ID)
+	if err != nil || ok {
+		t.Fatalf("session should not exist: %v %v", ok, err)
+	}
+}
+
+// Test that the user binding is persisted next to the values, not in them
+func TestStoreUserID(t *testing.T) {
+	backend := newMemoryBackend()
+	store := NewStore(backend, []byte("some key"))
+	ctx := context.Background()
+
+	session := sessions.NewSession(store, "hello")
+	session.Options = &sessions.Options{MaxAge: 60}
+	SetUserID(session, "alice")
+	if err := store.SaveByID(ctx, session); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+
+	if backend.records[session.ID].UserID != "alice" {
+		t.Fatalf("bad record user ID %q", backend.records[session.ID].UserID)
+	}
+
+	loaded, err := store.LoadByID(ctx, "hello", session.ID)
+	if err != nil {
+		t.Fatal("failed to load session", err)
+	}
+	if UserID(loaded) != "alice" {
+		t.Fatalf("bad user ID %q", UserID(loaded))
+	}
+
+	if err := store.RevokeAllForUser(ctx, "alice"); err != ErrNotSupported {
+		t.Fatalf("expected ErrNotSupported, got %v", err)
+	}
+}
+
+// Test moving a session to a new ID without back-end support for renames
+func TestStoreRegenerateID(t *testing.T) {
+	backend := newMemoryBackend()
+	store := NewStore(backend, []byte("some key"))
+
+	req, err := http.NewRequest("GET", "http://www.example.com", nil)
+	if err != nil {
+		t.Fatal("failed to create request", err)
+	}
+
+	session, err := store.New(req, "hello")
+	if err != nil {
+		t.Fatal("failed to create session", err)
+	}
+	session.Values["foo"] = "bar"
+	if err := session.Save(req, httptest.NewRecorder()); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+
+	oldID := session.ID
+	w := httptest.NewRecorder()
+	if err := store.RegenerateID(req, w, session); err != nil {
+		t.Fatal("failed to regenerate session ID", err)
+	}
+	if session.ID == oldID {
+		t.Fatal("session ID not changed")
+	}
+	if _, ok := backend.records[oldID]; ok {
+		t.Fatal("old session not deleted")
+	}
+
+	req, err = http.NewRequest("GET", "http://www.example.com", nil)
+	if err != nil {
+		t.Fatal("failed to create request", err)
+	}
+	req.Header.Add("Cookie", w.Header().Get("Set-Cookie"))
+
+	loaded, err := store.New(req, "hello")
+	if err != nil {
+		t.Fatal("failed to load session", err)
+	}
+	if loaded.ID != session.ID || loaded.Values["foo"] != "bar" {
+		t.Fatalf("session not loaded from the new cookie: %q %v", loaded.ID, loaded.Values)
+	}
+}
+
+// Test session values round trips with each serializer, with and without value codecs
+func TestStoreSerializers(t *testing.T) {
+	serializers := map[string]Serializer{
+		"gob":     GobSerializer{},
+		"json":    JSONSerializer{},
+		"msgpack": MsgpackSerializer{},
+	}
+
+	for name, serializer := range serializers {
+		for _, codecs := range [][]securecookie.Codec{nil, NewValueCodecs([]byte("values key"))} {
+			backend := newMemoryBackend()
+			store := NewStore(backend, []byte("some key"))
+			store.Serializer = serializer
+			store.ValueCodecs = codecs
+			ctx := context.Background()
+
+			session := sessions.NewSession(store, "hello")
+			session.Options = &sessions.Options{MaxAge: 60}
+			session.Values["foo"] = "bar"
+			SetUserID(session, "alice")
+			if err := store.SaveByID(ctx, session); err != nil {
+				t.Fatalf("%s: failed to save session: %v", name, err)
+			}
+
+			value := backend.records[session.ID].Value
+			if codecs == nil && name == "json" && string(value) != `{"foo":"bar"}` {
+				t.Fatalf("%s: bad stored value %s", name, value)
+			}
+
+			loaded, err := store.LoadByID(ctx, "hello", session.ID)
+			if err != nil {
+				t.Fatalf("%s: failed to load session: %v", name, err)
+			}
+			if loaded.Values["foo"] != "bar" || UserID(loaded) != "alice" {
+				t.Fatalf("%s: session not loaded: %v", name, loaded.Values)
+			}
+		}
+	}
+
+	store := NewStore(newMemoryBackend(), []byte("some key"))
+	store.Serializer = JSONSerializer{}
+	session := sessions.NewSession(store, "hello")
+	session.Options = &sessions.Options{MaxAge: 60}
+	session.Values[42] = "bar"
+	if err := store.SaveByID(context.Background(), session); err == nil {
+		t.Fatal("non-string keys should not be encoded to JSON")
+	}
+}
+
+// Test that values at rest are not limited to the length of a cookie
+func TestStoreLargeValues(t *testing.T) {
+	large := strings.Repeat("x", 5000)
+
+	for name, serializer := range map[string]Serializer{"codecs": nil, "json": JSONSerializer{}} {
+		store := NewStore(newMemoryBackend(), []byte("some key"))
+		store.Serializer = serializer
+		if serializer != nil {
+			store.ValueCodecs = NewValueCodecs([]byte("values key"))
+		}
+		ctx := context.Background()
+
+		session := sessions.NewSession(store, "hello")
+		session.Options = &sessions.Options{MaxAge: 60}
+		session.Values["foo"] = large
+		if err := store.SaveByID(ctx, session); err != nil {
+			t.Fatalf("%s: failed to save session: %v", name, err)
+		}
+
+		loaded, err := store.LoadByID(ctx, "hello", session.ID)
+		if err != nil {
+			t.Fatalf("%s: failed to load session: %v", name, err)
+		}
+		if loaded.Values["foo"] != large {
+			t.Fatalf("%s: large value not loaded", name)
+		}
+	}
+}
+
+// nativeBackend is a memoryBackend storing session values unencoded.
+type nativeBackend struct {
+	*memoryBackend
+}
+
+func (nativeBackend) StoresValues() bool {
+	return true
+}
+
+// Test that back-ends storing values natively get them unencoded
+func TestStoreValueStorer(t *testing.T) {
+	backend := nativeBackend{newMemoryBackend()}
+	store := NewStore(backend, []byte("some key"))
+	ctx := context.Background()
+
+	session := sessions.NewSession(store, "hello")
+	session.Options = &sessions.Options{MaxAge: 60}
+	session.Values["foo"] = "bar"
+	SetUserID(session, "alice")
+	if err := store.SaveByID(ctx, session); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+
+	rec := backend.records[session.ID]
+	if rec.Value != nil || len(rec.Values) != 1 || rec.Values["foo"] != "bar" {
+		t.Fatalf("bad record values %q %v", rec.Value, rec.Values)
+	}
+
+	loaded, err := store.LoadByID(ctx, "hello", session.ID)
+	if err != nil {
+		t.Fatal("failed to load session", err)
+	}
+	if loaded.Values["foo"] != "bar" || UserID(loaded) != "alice" {
+		t.Fatalf("session not loaded: %v", loaded.Values)
+	}
+}
+
+// Test the idle and absolute timeouts and touching a session
+func TestStoreTimeouts(t *testing.T) {
+	backend := newMemoryBackend()
+	store := NewStore(backend, []byte("some key"))
+	store.IdleTimeout = time.Hour
+	store.AbsoluteTimeout = 24 * time.Hour
+	ctx := context.Background()
+
+	session := sessions.NewSession(store, "hello")
+	session.Options = &sessions.Options{MaxAge: 86400 * 30}
+	if err := store.SaveByID(ctx, session); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	if rec := backend.records[session.ID]; rec.ExpiresAt.After(time.Now().Add(time.Hour)) {
+		t.Fatalf("expiry not shortened to the idle timeout: %v", rec.ExpiresAt)
+	}
+
+	// Seen two hours ago: idle.
+	rec := backend.records[session.ID]
+	rec.Updated = time.Now().Add(-2 * time.Hour)
+	backend.records[session.ID] = rec
+	if _, err := store.LoadByID(ctx, "hello", session.ID); err != ErrSessionExpired {
+		t.Fatalf("expected ErrSessionExpired for an idle session, got %v", err)
+	}
+	if ok, err := store.Exists(ctx, session.ID); err != nil || ok {
+		t.Fatalf("expected an idle session not to exist, got %v, %v", ok, err)
+	}
+
+	// Touched: active again.
+	if err := store.Touch(ctx, session); err != nil {
+		t.Fatal("failed to touch session", err)
+	}
+	loaded, err := store.LoadByID(ctx, "hello", session.ID)
+	if err != nil {
+		t.Fatal("touched session should load", err)
+	}
+	if ok, err := store.Exists(ctx, session.ID); err != nil || !ok {
+		t.Fatalf("expected a touched session to exist, got %v, %v", ok, err)
+	}
+
+	// Created 23h30 ago: touching cannot extend it past the absolute timeout.
+	rec = backend.records[session.ID]
+	rec.Created = time.Now().Add(-23*time.Hour - 30*time.Minute)
+	backend.records[session.ID] = rec
+	if loaded, err = store.LoadByID(ctx, "hello", session.ID); err != nil {
+		t.Fatal("failed to load session", err)
+	}
+	if err := store.Touch(ctx, loaded); err != nil {
+		t.Fatal("failed to touch session", err)
+	}
+	if rec := backend.records[session.ID]; rec.ExpiresAt.After(time.Now().Add(30 * time.Minute)) {
+		t.Fatalf("expiry extended past the absolute timeout: %v", rec.ExpiresAt)
+	}
+
+	rec = backend.records[session.ID]
+	rec.Created = time.Now().Add(-25 * time.Hour)
+	backend.records[session.ID] = rec
+	if _, err := store.LoadByID(ctx, "hello", session.ID); err != ErrSessionExpired {
+		t.Fatalf("expected ErrSessionExpired past the absolute timeout, got %v", err)
+	}
+	if ok, err := store.Exists(ctx, session.ID); err != nil || ok {
+		t.Fatalf("expected a session past the absolute timeout not to exist, got %v, %v", ok, err)
+	}
+}
+
+// Test that a session kept alive by touches alone still loads after its
+// values were written longer than MaxAge ago
+func TestStoreTouchPastMaxAge(t *testing.T) {
+	store := NewStore(newMemoryBackend(), []byte("some key"))
+	store.MaxAge(1)
+	ctx := context.Background()
+
+	session := sessions.NewSession(store, "hello")
+	session.Options = &sessions.Options{MaxAge: 1}
+	session.Values["foo"] = "bar"
+	if err := store.SaveByID(ctx, session); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+
+	for i := 0; i < 5; i++ {
+		time.Sleep(500 * time.Millisecond)
+		if err := store.Touch(ctx, session); err != nil {
+			t.Fatal("failed to touch session", err)
+		}
+	}
+
+	loaded, err := store.LoadByID(ctx, "hello", session.ID)
+	if err != nil {
+		t.Fatal("touched session should load", err)
+	}
+	if loaded.Values["foo"] != "bar" {
+		t.Fatalf("session not loaded: %v", loaded.Values)
+	}
+}
+
+// versionedBackend is a memoryBackend checking and counting record versions.
+type versionedBackend struct {
+	*memoryBackend
+}
+
+func (b versionedBackend) Save(ctx context.Context, rec *Record) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	stored, ok := b.records[rec.ID]
+	if rec.Version != 0 && (!ok || stored.Version != rec.Version) {
+		return ErrConcurrentModification
+	}
+	rec.Version = stored.Version + 1
+	b.records[rec.ID] = *rec
+	return nil
+}
+
+// Test that touching a session by rewriting its record keeps it saveable,
+// with and without a cache in between
+func TestStoreTouchVersion(t *testing.T) {
+	for _, cached := range []bool{false, true} {
+		store := NewStore(versionedBackend{newMemoryBackend()}, []byte("some key"))
+		if cached {
+			store.EnableCache(10, time.Minute)
+		}
+		ctx := context.Background()
+
+		session := sessions.NewSession(store, "hello")
+		session.Options = &sessions.Options{MaxAge: 60}
+		if err := store.SaveByID(ctx, session); err != nil {
+			t.Fatal("failed to save session", err)
+		}
+		stale, err := store.LoadByID(ctx, "hello", session.ID)
+		if err != nil {
+			t.Fatal("failed to load session", err)
+		}
+
+		if err := store.Touch(ctx, session); err != nil {
+			t.Fatal("failed to touch session", err)
+		}
+		session.Values["foo"] = "bar"
+		if err := store.SaveByID(ctx, session); err != nil {
+			t.Fatalf("cached %v: failed to save touched session: %v", cached, err)
+		}
+
+		// A session behind the stored version still conflicts after a touch.
+		if err := store.Touch(ctx, stale); err != nil {
+			t.Fatal("failed to touch session", err)
+		}
+		if err := store.SaveByID(ctx, stale); err != ErrConcurrentModification {
+			t.Fatalf("cached %v: expected ErrConcurrentModification, got %v", cached, err)
+		}
+	}
+}
+
+// Test that saving an unchanged session skips the write, or only touches it
+func TestStoreSkipUnchanged(t *testing.T) {
+	backend := newMemoryBackend()
+	store := NewStore(backend, []byte("some key"))
+	store.SkipUnchanged = true
+	ctx := context.Background()
+
+	session := sessions.NewSession(store, "hello")
+	session.Options = &sessions.Options{MaxAge: 60}
+	session.Values["foo"] = "bar"
+	session.Values[42] = []string{"a", "b"}
+	if err := store.SaveByID(ctx, session); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+
+	loaded, err := store.LoadByID(ctx, "hello", session.ID)
+	if err != nil {
+		t.Fatal("failed to load session", err)
+	}
+
+	// updated rewinds the stored record to tell whether it was written.
+	updated := func() time.Time {
+		rec := backend.records[session.ID]
+		rec.Updated = time.Now().Add(-time.Hour)
+		rec.ExpiresAt = time.Now().Add(time.Second)
+		backend.records[session.ID] = rec
+		return rec.Updated
+	}
+
+	before := updated()
+	if err := store.SaveByID(ctx, loaded); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	if !backend.records[session.ID].Updated.Equal(before) {
+		t.Fatal("unchanged session written")
+	}
+
+	store.TouchUnchanged = true
+	before = updated()
+	if err := store.SaveByID(ctx, loaded); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	if rec := backend.records[session.ID]; rec.Updated.Equal(before) || rec.ExpiresAt.Before(time.Now().Add(time.Minute-time.Second)) {
+		t.Fatal("unchanged session not touched")
+	}
+
+	store.TouchUnchanged = false
+	for _, change := range []func(){
+		func() { loaded.Values["foo"] = "baz" },
+		func() { SetUserID(loaded, "alice") },
+	} {
+		change()
+		before = updated()
+		if err := store.SaveByID(ctx, loaded); err != nil {
+			t.Fatal("failed to save session", err)
+		}
+		if backend.records[session.ID].Updated.Equal(before) {
+			t.Fatal("changed session not written")
+		}
+	}
+}
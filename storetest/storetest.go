@@ -0,0 +1,344 @@
+// Package storetest is a conformance test suite for gorilla sessions.Store
+// implementations keeping session values server-side, such as the stores
+// of package vagorillasessionsstores. Run it from a test of the store:
+//
+//	func TestConformance(t *testing.T) {
+//		storetest.RunConformance(t, func(t *testing.T, keyPairs ...[]byte) sessions.Store {
+//			return mystore.New(db, keyPairs...)
+//		})
+//	}
+package storetest
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// Factory returns a store using keyPairs, see securecookie.CodecsFromPairs().
+//
+// All the stores a factory returns during one RunConformance() call must
+// share their storage, as the instances of an application sharing a
+// database do. The suite saves sessions with MaxAge down to one second.
+type Factory func(t *testing.T, keyPairs ...[]byte) sessions.Store
+
+// sessionName is the name of the sessions saved by the suite.
+const sessionName = "conformance"
+
+// RunConformance runs the conformance suite against the stores of factory,
+// each check in its own subtest.
+func RunConformance(t *testing.T, factory Factory) {
+	t.Run("IsNew", func(t *testing.T) { testIsNew(t, factory) })
+	t.Run("RoundTrip", func(t *testing.T) { testRoundTrip(t, factory) })
+	t.Run("Delete", func(t *testing.T) { testDelete(t, factory) })
+	t.Run("TamperedCookie", func(t *testing.T) { testTamperedCookie(t, factory) })
+	t.Run("Expiry", func(t *testing.T) { testExpiry(t, factory) })
+	t.Run("Concurrency", func(t *testing.T) { testConcurrency(t, factory) })
+	t.Run("KeyRotation", func(t *testing.T) { testKeyRotation(t, factory) })
+}
+
+// newKeys returns a new authentication and encryption key pair.
+func newKeys() [][]byte {
+	return [][]byte{securecookie.GenerateRandomKey(32), securecookie.GenerateRandomKey(32)}
+}
+
+// pairs flattens key pairs, newest first, into the arguments of a Factory.
+func pairs(keys ...[][]byte) [][]byte {
+	var flat [][]byte
+	for _, k := range keys {
+		flat = append(flat, k...)
+	}
+	return flat
+}
+
+// request returns a request sending cookie, if not nil.
+func request(cookie *http.Cookie) *http.Request {
+	r := httptest.NewRequest("GET", "http://www.example.com", nil)
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+	return r
+}
+
+// load returns the session sent with cookie, failing the test on errors.
+func load(t *testing.T, store sessions.Store, cookie *http.Cookie) *sessions.Session {
+	t.Helper()
+	session, err := store.New(request(cookie), sessionName)
+	if err != nil {
+		t.Fatal("failed to load session:", err)
+	}
+	return session
+}
+
+// save saves session and returns the cookie set in the response.
+func save(t *testing.T, store sessions.Store, session *sessions.Session) *http.Cookie {
+	t.Helper()
+	w := httptest.NewRecorder()
+	if err := store.Save(request(nil), w, session); err != nil {
+		t.Fatal("failed to save session:", err)
+	}
+
+	for _, c := range w.Result().Cookies() {
+		if c.Name == session.Name() {
+			return c
+		}
+	}
+	t.Fatal("no cookie set for session", session.Name())
+	return nil
+}
+
+// saveNew saves a new session holding values and returns its cookie.
+func saveNew(t *testing.T, store sessions.Store, values map[string]interface{}) *http.Cookie {
+	t.Helper()
+	session := load(t, store, nil)
+	for k, v := range values {
+		session.Values[k] = v
+	}
+	return save(t, store, session)
+}
+
+// userValues returns the values of session under string keys. Stores may
+// keep their own data in values under keys of other types.
+func userValues(session *sessions.Session) map[string]interface{} {
+	values := make(map[string]interface{})
+	for k, v := range session.Values {
+		if key, ok := k.(string); ok {
+			values[key] = v
+		}
+	}
+	return values
+}
+
+// checkValues fails the test unless session holds exactly values.
+func checkValues(t *testing.T, session *sessions.Session, values map[string]interface{}) {
+	t.Helper()
+	if got := userValues(session); len(got) != len(values) {
+		t.Fatalf("expected %d values, got %v", len(values), got)
+	}
+	for k, v := range values {
+		if got := session.Values[k]; got != v {
+			t.Fatalf("value %q: expected %v (%T), got %v (%T)", k, v, v, got, got)
+		}
+	}
+}
+
+// checkNew fails the test unless session is a new, empty session.
+func checkNew(t *testing.T, session *sessions.Session) {
+	t.Helper()
+	if !session.IsNew {
+		t.Fatal("expected a new session")
+	}
+	if values := userValues(session); len(values) != 0 {
+		t.Fatalf("expected a new session to be empty, got %v", values)
+	}
+}
+
+func testIsNew(t *testing.T, factory Factory) {
+	store := factory(t, newKeys()...)
+
+	session := load(t, store, nil)
+	if !session.IsNew {
+		t.Fatal("expected a request without cookie to get a new session")
+	}
+
+	cookie := save(t, store, session)
+	loaded := load(t, store, cookie)
+	if loaded.IsNew {
+		t.Fatal("expected a saved session not to be new")
+	}
+	if loaded.ID != session.ID || loaded.ID == "" {
+		t.Fatalf("expected session ID %q, got %q", session.ID, loaded.ID)
+	}
+}
+
+func testRoundTrip(t *testing.T, factory Factory) {
+	store := factory(t, newKeys()...)
+
+	values := map[string]interface{}{
+		"string": "value",
+		"int":    42,
+		"float":  3.5,
+		"bool":   true,
+	}
+	cookie := saveNew(t, store, values)
+
+	session := load(t, store, cookie)
+	checkValues(t, session, values)
+
+	// Changes and removals must be saved too.
+	session.Values["string"] = "changed"
+	delete(session.Values, "bool")
+	cookie = save(t, store, session)
+
+	checkValues(t, load(t, store, cookie), map[string]interface{}{
+		"string": "changed",
+		"int":    42,
+		"float":  3.5,
+	})
+}
+
+func testDelete(t *testing.T, factory Factory) {
+	store := factory(t, newKeys()...)
+
+	for _, maxAge := range []int{0, -1} {
+		t.Run(fmt.Sprintf("MaxAge%d", maxAge), func(t *testing.T) {
+			cookie := saveNew(t, store, map[string]interface{}{"foo": "bar"})
+
+			session := load(t, store, cookie)
+			session.Options.MaxAge = maxAge
+			if removal := save(t, store, session); removal.Value != "" {
+				t.Fatalf("expected an empty cookie, got %q", removal.Value)
+			}
+
+			// A client holding on to the old cookie must not get the session back.
+			checkNew(t, load(t, store, cookie))
+		})
+	}
+}
+
+func testTamperedCookie(t *testing.T, factory Factory) {
+	store := factory(t, newKeys()...)
+	cookie := saveNew(t, store, map[string]interface{}{"foo": "bar"})
+
+	tampered := *cookie
+	i := len(tampered.Value) / 2
+	flipped := "A"
+	if tampered.Value[i] == 'A' {
+		flipped = "B"
+	}
+	tampered.Value = tampered.Value[:i] + flipped + tampered.Value[i+1:]
+
+	// A valid cookie of another session name must not be accepted either.
+	renamed := *cookie
+	renamed.Name = sessionName + "-other"
+
+	for name, c := range map[string]*http.Cookie{"tampered": &tampered, "renamed": &renamed} {
+		session, err := store.New(request(c), c.Name)
+		if err == nil {
+			t.Fatalf("expected an error for a %s cookie", name)
+		}
+		if session == nil {
+			t.Fatalf("expected a new session with the error for a %s cookie", name)
+		}
+		checkNew(t, session)
+	}
+}
+
+func testExpiry(t *testing.T, factory Factory) {
+	store := factory(t, newKeys()...)
+
+	session := load(t, store, nil)
+	session.Values["foo"] = "bar"
+	session.Options.MaxAge = 1
+	cookie := save(t, store, session)
+
+	time.Sleep(2 * time.Second)
+
+	// An expired session may come with an error, it must not come back.
+	expired, _ := store.New(request(cookie), sessionName)
+	if expired == nil {
+		t.Fatal("expected a new session for an expired one")
+	}
+	checkNew(t, expired)
+}
+
+func testConcurrency(t *testing.T, factory Factory) {
+	store := factory(t, newKeys()...)
+	shared := saveNew(t, store, map[string]interface{}{"shared": "value"})
+
+	const workers = 16
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(2)
+
+		// Sessions of their own, saved and loaded in parallel.
+		go func(i int) {
+			defer wg.Done()
+			errs <- roundTrip(store, i)
+		}(i)
+
+		// One session, loaded in parallel.
+		go func() {
+			defer wg.Done()
+			session, err := store.New(request(shared), sessionName)
+			if err == nil && session.Values["shared"] != "value" {
+				err = fmt.Errorf("expected the shared value, got %v", session.Values)
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// roundTrip saves a new session holding i and checks that it loads back,
+// without failing the test so that it can run in its own goroutine.
+func roundTrip(store sessions.Store, i int) error {
+	session, err := store.New(request(nil), sessionName)
+	if err != nil {
+		return err
+	}
+	session.Values["worker"] = i
+
+	w := httptest.NewRecorder()
+	if err := store.Save(request(nil), w, session); err != nil {
+		return err
+	}
+
+	cookies := w.Result().Cookies()
+	if len(cookies) == 0 {
+		return fmt.Errorf("worker %d: no cookie set", i)
+	}
+	loaded, err := store.New(request(cookies[0]), sessionName)
+	if err != nil {
+		return err
+	}
+	if loaded.IsNew || loaded.Values["worker"] != i {
+		return fmt.Errorf("worker %d: expected its session back, got %v", i, loaded.Values)
+	}
+	return nil
+}
+
+func testKeyRotation(t *testing.T, factory Factory) {
+	oldPair, newPair := newKeys(), newKeys()
+	values := map[string]interface{}{"foo": "bar"}
+
+	oldStore := factory(t, pairs(oldPair)...)
+	oldCookie := saveNew(t, oldStore, values)
+
+	// During a rotation the old keys still decode.
+	rotating := factory(t, pairs(newPair, oldPair)...)
+	session := load(t, rotating, oldCookie)
+	if session.IsNew {
+		t.Fatal("expected a session saved with the old keys to load during rotation")
+	}
+	checkValues(t, session, values)
+	newCookie := save(t, rotating, session)
+
+	// Once rotated, sessions saved during rotation load and the old keys are rejected.
+	rotated := factory(t, pairs(newPair)...)
+	session = load(t, rotated, newCookie)
+	if session.IsNew {
+		t.Fatal("expected a session saved during rotation to load with the new keys")
+	}
+	checkValues(t, session, values)
+
+	session, err := rotated.New(request(oldCookie), sessionName)
+	if err == nil {
+		t.Fatal("expected an error for a cookie of the old keys")
+	}
+	checkNew(t, session)
+}
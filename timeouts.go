@@ -0,0 +1,106 @@
+package vagorillasessionsstores
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+// createdKey holds the creation time of a loaded session in its values.
+const createdKey metaKey = "created"
+
+// Toucher is implemented by back-ends able to refresh the expiry of a
+// session without rewriting its values.
+type Toucher interface {
+	// Touch sets the Updated and ExpiresAt times of the record stored under id.
+	// It returns ErrSessionNotFound if the record is missing, and
+	// ErrNotSupported to have the store rewrite the record instead.
+	Touch(ctx context.Context, id string, updated, expiresAt time.Time) error
+}
+
+// Touch marks session as seen now, extending its idle timeout without
+// encoding or writing its values. Call it on each authenticated request
+// that does not otherwise save the session. The expiry never moves past
+// the absolute timeout.
+//
+// Back-ends without Toucher support rewrite the stored record as is.
+func (s *Store) Touch(ctx context.Context, session *sessions.Session) (err error) {
+	if session.ID == "" {
+		return ErrSessionNotFound
+	}
+	ctx, done := s.start(ctx, "touch", session.Name())
+	defer func() { done(err) }()
+
+	now := time.Now()
+	expiresAt := s.expiresAt(session, now)
+
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	if toucher, ok := s.backend.(Toucher); ok {
+		err := toucher.Touch(ctx, session.ID, now, expiresAt)
+		if !errors.Is(err, ErrNotSupported) {
+			return backendError(s.backend, "touch", err)
+		}
+	}
+
+	rec, err := s.backend.Load(ctx, session.ID)
+	if err != nil {
+		return backendError(s.backend, "touch", err)
+	}
+	loaded := rec.Version
+	rec.Updated = now
+	rec.ExpiresAt = expiresAt
+	if err := s.backend.Save(ctx, rec); err != nil {
+		return backendError(s.backend, "touch", err)
+	}
+
+	// The rewrite bumped the stored version: follow it unless session was
+	// already behind, so that its next save still detects the conflict.
+	if version(session) == loaded {
+		setVersion(session, rec.Version)
+	}
+	return nil
+}
+
+// created returns the creation time of session, now if it was never saved.
+func created(session *sessions.Session, now time.Time) time.Time {
+	if created, ok := session.Values[createdKey].(time.Time); ok {
+		return created
+	}
+	return now
+}
+
+// expiresAt returns the expiry of session when saved or touched at now:
+// its MaxAge, shortened to the store's idle timeout and capped by its
+// absolute timeout.
+func (s *Store) expiresAt(session *sessions.Session, now time.Time) time.Time {
+	expiresAt := now.Add(time.Duration(session.Options.MaxAge) * time.Second)
+
+	if s.IdleTimeout > 0 {
+		if idle := now.Add(s.IdleTimeout); idle.Before(expiresAt) {
+			expiresAt = idle
+		}
+	}
+	if s.AbsoluteTimeout > 0 {
+		if absolute := created(session, now).Add(s.AbsoluteTimeout); absolute.Before(expiresAt) {
+			expiresAt = absolute
+		}
+	}
+
+	return expiresAt
+}
+
+// checkTimeouts returns ErrSessionExpired if rec is past the store's idle or
+// absolute timeout at now.
+func (s *Store) checkTimeouts(rec *Record, now time.Time) error {
+	if s.IdleTimeout > 0 && !rec.Updated.IsZero() && now.Sub(rec.Updated) > s.IdleTimeout {
+		return ErrSessionExpired
+	}
+	if s.AbsoluteTimeout > 0 && !rec.Created.IsZero() && now.Sub(rec.Created) > s.AbsoluteTimeout {
+		return ErrSessionExpired
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package vagorillasessionsstores
+
+import (
+	"context"
+	"time"
+)
+
+// Tracer starts spans around the back-end operations of a Store. It is small
+// enough to adapt any tracing library, e.g. OpenTelemetry, in a few lines.
+type Tracer interface {
+	// Start starts a span called name, a child of the span in ctx if any,
+	// and returns a context holding it. The context is passed on to the
+	// back-end, so spans of an instrumented database driver nest in it.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is an operation traced by a Tracer.
+type Span interface {
+	SetAttribute(key, value string)
+	// RecordError is called before End for failed operations. A missing or
+	// expired session is an outcome, not a failure.
+	RecordError(err error)
+	End()
+}
+
+// start begins the operation op on the session called name, which may be
+// empty. It starts a span named "session.<op>" with the store's Tracer and
+// returns the function ending it, which also reports the operation to the
+// store's Observer.
+func (s *Store) start(ctx context.Context, op, name string) (context.Context, func(error)) {
+	start := time.Now()
+	if s.Tracer == nil {
+		return ctx, func(err error) { s.observe(op, start, err) }
+	}
+
+	ctx, span := s.Tracer.Start(ctx, "session."+op)
+	span.SetAttribute("session.backend", backendName(s.backend))
+	if name != "" {
+		span.SetAttribute("session.name", name)
+	}
+
+	return ctx, func(err error) {
+		s.observe(op, start, err)
+
+		outcome := outcomeOf(err)
+		span.SetAttribute("session.outcome", string(outcome))
+		if outcome != OutcomeOK && outcome != OutcomeNotFound && outcome != OutcomeExpired {
+			span.RecordError(err)
+		}
+		span.End()
+	}
+}
@@ -0,0 +1,102 @@
+package vagorillasessionsstores
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/gorilla/sessions"
+)
+
+type spanKey struct{}
+
+// recordingTracer records its spans and puts the current one in the context.
+type recordingTracer struct {
+	spans []*recordingSpan
+}
+
+type recordingSpan struct {
+	name       string
+	attributes map[string]string
+	err        error
+	ended      bool
+}
+
+func (t *recordingTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	span := &recordingSpan{name: name, attributes: make(map[string]string)}
+	t.spans = append(t.spans, span)
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+func (s *recordingSpan) SetAttribute(key, value string) { s.attributes[key] = value }
+func (s *recordingSpan) RecordError(err error)          { s.err = err }
+func (s *recordingSpan) End()                           { s.ended = true }
+
+// tracedBackend is a memoryBackend failing if called outside of a span.
+type tracedBackend struct {
+	*memoryBackend
+}
+
+func (b tracedBackend) Load(ctx context.Context, id string) (*Record, error) {
+	if ctx.Value(spanKey{}) == nil {
+		return nil, errors.New("load outside of a span")
+	}
+	return b.memoryBackend.Load(ctx, id)
+}
+
+func (b tracedBackend) Save(ctx context.Context, rec *Record) error {
+	if ctx.Value(spanKey{}) == nil {
+		return errors.New("save outside of a span")
+	}
+	return b.memoryBackend.Save(ctx, rec)
+}
+
+// Test that back-end calls run inside spans carrying their outcome
+func TestStoreTracer(t *testing.T) {
+	store := NewStore(tracedBackend{newMemoryBackend()}, []byte("some key"))
+	tracer := &recordingTracer{}
+	store.Tracer = tracer
+	ctx := context.Background()
+
+	session := sessions.NewSession(store, "hello")
+	session.Options = &sessions.Options{MaxAge: 60}
+	session.Values["foo"] = "bar"
+	if err := store.SaveByID(ctx, session); err != nil {
+		t.Fatal("failed to save session", err)
+	}
+	if _, err := store.LoadByID(ctx, "hello", session.ID); err != nil {
+		t.Fatal("failed to load session", err)
+	}
+	if _, err := store.LoadByID(ctx, "hello", "missing"); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatal("expected ErrSessionNotFound, got", err)
+	}
+	session.Values["bad"] = make(chan int)
+	if err := store.SaveByID(ctx, session); err == nil {
+		t.Fatal("expected an error saving a value that does not encode")
+	}
+
+	expected := []struct {
+		name, outcome string
+		failed        bool
+	}{
+		{"session.save", "ok", false},
+		{"session.load", "ok", false},
+		{"session.load", "not_found", false},
+		{"session.save", "invalid", true},
+	}
+	if len(tracer.spans) != len(expected) {
+		t.Fatalf("expected %d spans, got %d", len(expected), len(tracer.spans))
+	}
+	for i, e := range expected {
+		span := tracer.spans[i]
+		if span.name != e.name || span.attributes["session.outcome"] != e.outcome {
+			t.Fatalf("span %d: expected %s %s, got %s %s", i, e.name, e.outcome, span.name, span.attributes["session.outcome"])
+		}
+		if span.attributes["session.name"] != "hello" || span.attributes["session.backend"] == "" {
+			t.Fatalf("span %d: missing attributes %v", i, span.attributes)
+		}
+		if (span.err != nil) != e.failed || !span.ended {
+			t.Fatalf("span %d: unexpected error %v or not ended", i, span.err)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package vagorillasessionsstores
+
+import (
+	"context"
+
+	"github.com/gorilla/sessions"
+)
+
+// userIDKey holds the ID of the user owning a session in its values.
+const userIDKey metaKey = "userid"
+
+// UserIndexer is implemented by back-ends able to find sessions by the user owning them.
+type UserIndexer interface {
+	// ListByUser returns the live sessions owned by userID.
+	ListByUser(ctx context.Context, userID string) ([]SessionInfo, error)
+	// DeleteByUser deletes every session owned by userID.
+	DeleteByUser(ctx context.Context, userID string) error
+}
+
+// SetUserID binds session to the user, or any other principal, identified by
+// userID. The binding is persisted on the next save and lets
+// RevokeAllForUser() find the session. An empty userID removes the binding.
+func SetUserID(session *sessions.Session, userID string) {
+	if userID == "" {
+		delete(session.Values, userIDKey)
+		return
+	}
+	session.Values[userIDKey] = userID
+}
+
+// UserID returns the ID of the user session is bound to, empty if none.
+func UserID(session *sessions.Session) string {
+	userID, _ := session.Values[userIDKey].(string)
+	return userID
+}
+
+// ListSessionsForUser returns the live sessions bound to userID with SetUserID().
+// An empty userID owns no session.
+//
+// It returns ErrNotSupported if the back-end cannot index sessions by user.
+func (s *Store) ListSessionsForUser(ctx context.Context, userID string) ([]SessionInfo, error) {
+	indexer, ok := s.backend.(UserIndexer)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	if userID == "" {
+		return nil, nil
+	}
+
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	infos, err := indexer.ListByUser(ctx, userID)
+	return infos, backendError(s.backend, "list", err)
+}
+
+// RevokeAllForUser deletes every session bound to userID with SetUserID(),
+// e.g. to log a user out everywhere after a password change. An empty userID
+// owns no session, sessions not bound to a user are left alone.
+//
+// It returns ErrNotSupported if the back-end cannot index sessions by user.
+func (s *Store) RevokeAllForUser(ctx context.Context, userID string) error {
+	indexer, ok := s.backend.(UserIndexer)
+	if !ok {
+		return ErrNotSupported
+	}
+	if userID == "" {
+		return nil
+	}
+
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	return backendError(s.backend, "delete", indexer.DeleteByUser(ctx, userID))
+}
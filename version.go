@@ -0,0 +1,55 @@
+package vagorillasessionsstores
+
+import (
+	"context"
+	"errors"
+
+	"github.com/gorilla/sessions"
+)
+
+// versionKey holds the version of the stored record of a session in its values.
+const versionKey metaKey = "version"
+
+// maxMergeAttempts bounds the saves of a session conflicting with concurrent requests.
+const maxMergeAttempts = 3
+
+// MergeFunc merges the changes made to session into stored, the session as
+// saved meanwhile by a concurrent request, leaving the result in session,
+// which is then saved again. Returning an error gives up the save.
+//
+// A MergeFunc returning nil without changing session makes the last writer
+// win, as before versions were checked.
+type MergeFunc func(ctx context.Context, session, stored *sessions.Session) error
+
+// version returns the version of the stored record session was loaded from, zero if unknown.
+func version(session *sessions.Session) int64 {
+	v, _ := session.Values[versionKey].(int64)
+	return v
+}
+
+// setVersion records the version of the stored record of session.
+func setVersion(session *sessions.Session, v int64) {
+	if v == 0 {
+		delete(session.Values, versionKey)
+		return
+	}
+	session.Values[versionKey] = v
+}
+
+// merge reloads session after a save conflict and lets Merge resolve it.
+func (s *Store) merge(ctx context.Context, session *sessions.Session) error {
+	stored, err := s.LoadByID(ctx, session.Name(), session.ID)
+	if errors.Is(err, ErrSessionNotFound) || errors.Is(err, ErrSessionExpired) {
+		// Deleted meanwhile, e.g. by a logout: do not bring it back.
+		return ErrConcurrentModification
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := s.Merge(ctx, session, stored); err != nil {
+		return err
+	}
+	setVersion(session, version(stored))
+	return nil
+}